@@ -0,0 +1,314 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// app.net is gone, but its API lives on in services like pnut.io,
+// so we talk to whatever ADN-compatible service is configured.
+const (
+	adnDefaultAPIHost = "https://api.pnut.io"
+	adnDefaultAuthURL = "https://pnut.io/oauth/authenticate"
+	// maximum length of a post
+	adnMaxChars = 256
+	// most files we attach to a post
+	adnMaxPhotos = 4
+)
+
+var adnImageLimits = imageLimits{
+	MaxWidth:  4096,
+	MaxHeight: 4096,
+	MaxBytes:  5 << 20,
+	Formats:   []string{"jpeg", "png", "gif"},
+}
+
+var errADNAuth = errors.New("adn: access token rejected")
+
+func init() {
+	registerPublisher(adnPublisher{})
+}
+
+// adnConfigured reports whether the ADN client credentials are set.
+// Unlike the other networks, ADN is optional.
+func adnConfigured() bool {
+	return appConfig.ADNClientId != "" && appConfig.ADNClientSecret != ""
+}
+
+func adnAPIHost() string {
+	if appConfig.ADNAPIHost != "" {
+		return strings.TrimRight(appConfig.ADNAPIHost, "/")
+	}
+	return adnDefaultAPIHost
+}
+
+func adnAuthURL() string {
+	if appConfig.ADNAuthURL != "" {
+		return appConfig.ADNAuthURL
+	}
+	return adnDefaultAuthURL
+}
+
+func adnHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	if !adnConfigured() {
+		serve404(w)
+		return
+	}
+
+	redirectUrl := "http://" + appConfig.AppHost + "/adn"
+	code := r.FormValue("code")
+	if code == "" {
+		id := sessionUserId(r)
+		if id == "" {
+			serveError(c, w, errors.New("Not signed in"))
+			return
+		}
+		state, err := newOAuthState(w, r, "adn", id)
+		if err != nil {
+			serveError(c, w, err)
+			return
+		}
+		q := url.Values{
+			"client_id":     {appConfig.ADNClientId},
+			"redirect_uri":  {redirectUrl},
+			"response_type": {"code"},
+			"scope":         {"basic write_post files"},
+			"state":         {state},
+		}
+		http.Redirect(w, r, adnAuthURL()+"?"+q.Encode(), http.StatusFound)
+		return
+	}
+
+	id, err := checkOAuthState(w, r, "adn", r.FormValue("state"))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	form := url.Values{
+		"client_id":     {appConfig.ADNClientId},
+		"client_secret": {appConfig.ADNClientSecret},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {redirectUrl},
+		"code":          {code},
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		UserId      string `json:"user_id"`
+		Username    string `json:"username"`
+	}
+	req, err := http.NewRequest("POST", adnAPIHost()+"/v1/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := adnSend(httpClient(c), req, "", &tok); err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	user, err := loadUser(c, id)
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			err = errors.New("Invalid user ID")
+		}
+		serveError(c, w, err)
+		return
+	}
+	user.ADNAccessToken = tok.AccessToken
+	user.ADNId = tok.UserId
+	user.ADNScreenName = tok.Username
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func deleteADNHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadUserDelete(w, r)
+	if !ok {
+		return
+	}
+	user.DisableADN()
+	saveUser(newContext(r), &user)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// adnPublisher posts activities to an ADN-compatible service.
+type adnPublisher struct{}
+
+func (adnPublisher) Name() string { return "adn" }
+
+func (adnPublisher) Enabled(user *User) bool {
+	return adnConfigured() && user.HasADN()
+}
+
+func (adnPublisher) Publish(c Context, user *User, post *Post) (string, error) {
+	client := httpClient(c)
+
+	act := post.Activity
+	attachment := post.Attachment
+	content := post.Content
+
+	p := map[string]interface{}{}
+	switch post.Kind {
+	case "status":
+		p["text"] = adnText(post, content, act.Url, false)
+	case "status_share":
+		if content == "" {
+			content = "Resharing " + act.ActorName
+		}
+		p["text"] = adnText(post, content, act.Url, true)
+	case "article":
+		if content == attachment.Url || content == "" {
+			content = attachment.DisplayName
+		}
+		p["text"] = adnText(post, content, attachment.Url, true)
+	case "photo":
+		photos, more := post.photos(adnMaxPhotos)
+		var raw []map[string]interface{}
+		for _, photo := range photos {
+			media, name, err := fetchImage(c, photo.Image, adnImageLimits)
+			if err != nil {
+				return "", err
+			}
+			var file struct {
+				Data struct {
+					Id        string `json:"id"`
+					FileToken string `json:"file_token"`
+				} `json:"data"`
+			}
+			err = adnUpload(client, user.ADNAccessToken, name, media, &file)
+			c.Debugf("Uploading %s to ADN (%v)\n", photo.Image, err)
+			if err != nil {
+				if err == errADNAuth {
+					user.DisableADN()
+				}
+				return "", err
+			}
+			raw = append(raw, map[string]interface{}{
+				"type": "io.pnut.core.oembed",
+				"value": map[string]interface{}{
+					"+io.pnut.core.file": map[string]string{
+						"file_id":    file.Data.Id,
+						"file_token": file.Data.FileToken,
+						"format":     "oembed",
+					},
+				},
+			})
+		}
+		p["text"] = adnText(post, content, act.Url, more)
+		p["raw"] = raw
+	default:
+		p["text"] = adnText(post, content, act.ObjectUrl, true)
+	}
+
+	p["entities"] = map[string]bool{"parse_markdown_links": true}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", adnAPIHost()+"/v1/posts", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var created struct {
+		Data struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+	err = adnSend(client, req, user.ADNAccessToken, &created)
+	if err == errADNAuth {
+		user.DisableADN()
+	}
+	c.Debugf("adnPublisher(%s): err=%v\n", post.Kind, err)
+	return created.Data.Id, err
+}
+
+// adnText fits content and link in a post like fitText. If nothing had
+// to be cut, it uses the Markdown version of the post instead, whose
+// links the service parses, as long as that fits too.
+func adnText(post *Post, content, link string, always bool) string {
+	text := fitText(content, link, adnMaxChars, 0, always)
+	if content != "" && content == post.Content && strings.HasPrefix(text, content) {
+		md := post.Markdown + text[len(content):]
+		if utf8.RuneCountInString(md) <= adnMaxChars {
+			text = md
+		}
+	}
+	return text
+}
+
+// adnUpload uploads a file to be attached to a post.
+func adnUpload(client *http.Client, token, fileName string, data []byte, v interface{}) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("type", "io.pnut.core.oembed")
+	mw.WriteField("kind", "image")
+	mw.WriteField("name", fileName)
+	fw, err := mw.CreateFormFile("content", fileName)
+	if err != nil {
+		return err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", adnAPIHost()+"/v1/files", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return adnSend(client, req, token, v)
+}
+
+func adnSend(client *http.Client, req *http.Request, token string, v interface{}) error {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errADNAuth
+	case resp.StatusCode >= 300:
+		var e struct {
+			Meta struct {
+				ErrorMessage string `json:"error_message"`
+			} `json:"meta"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		err := fmt.Errorf("adn: %s: %s", resp.Status, e.Meta.ErrorMessage)
+		if httpPermanent(resp.StatusCode) {
+			return permanent(err)
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
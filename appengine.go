@@ -0,0 +1,206 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+//go:build appengine
+// +build appengine
+
+package gplus2others
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/urlfetch"
+)
+
+func init() {
+	storage = datastoreStorage{}
+	users = datastoreUserStore{}
+	deliveries = datastoreDeliveryStore{}
+	cache = memcacheCache{}
+}
+
+type aeContext struct {
+	appengine.Context
+}
+
+func (c aeContext) Transport() http.RoundTripper {
+	return &urlfetch.Transport{Context: c.Context}
+}
+
+func newContext(r *http.Request) Context {
+	return aeContext{appengine.NewContext(r)}
+}
+
+// syncAllowed reports whether r may trigger a sync. On App Engine,
+// app.yaml already restricts /sync to cron and admins.
+func syncAllowed(r *http.Request) bool {
+	return true
+}
+
+func aeContextOf(c Context) appengine.Context {
+	for {
+		switch cc := c.(type) {
+		case deadlineContext:
+			c = cc.Context
+		case dryRunContext:
+			c = cc.Context
+		default:
+			return c.(aeContext).Context
+		}
+	}
+}
+
+// datastoreStorage keeps entities in the App Engine datastore.
+type datastoreStorage struct{}
+
+func (datastoreStorage) Get(c Context, kind, id string, dst interface{}) error {
+	ac := aeContextOf(c)
+	err := datastore.Get(ac, datastore.NewKey(ac, kind, id, 0, nil), dst)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchEntity
+	}
+	return err
+}
+
+func (datastoreStorage) Put(c Context, kind, id string, src interface{}) error {
+	ac := aeContextOf(c)
+	_, err := datastore.Put(ac, datastore.NewKey(ac, kind, id, 0, nil), src)
+	return err
+}
+
+func (datastoreStorage) Delete(c Context, kind, id string) error {
+	ac := aeContextOf(c)
+	return datastore.Delete(ac, datastore.NewKey(ac, kind, id, 0, nil))
+}
+
+// datastoreUserStore keeps users in the datastore as "User" entities.
+type datastoreUserStore struct{}
+
+func (datastoreUserStore) Get(c Context, id string) (*User, error) {
+	user := new(User)
+	if err := (datastoreStorage{}).Get(c, "User", id, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (datastoreUserStore) Put(c Context, user *User) error {
+	return (datastoreStorage{}).Put(c, "User", user.Id, user)
+}
+
+func (datastoreUserStore) Delete(c Context, id string) error {
+	return (datastoreStorage{}).Delete(c, "User", id)
+}
+
+func (datastoreUserStore) ListActive(c Context) ([]*User, error) {
+	var active []*User
+	q := datastore.NewQuery("User").Filter("Active=", true)
+	_, err := q.GetAll(aeContextOf(c), &active)
+	return active, err
+}
+
+// datastoreDeliveryStore keeps deliveries as "Delivery" entities.
+type datastoreDeliveryStore struct{}
+
+func (datastoreDeliveryStore) Get(c Context, id string) (*Delivery, error) {
+	d := new(Delivery)
+	if err := (datastoreStorage{}).Get(c, "Delivery", id, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (datastoreDeliveryStore) Put(c Context, d *Delivery) error {
+	return (datastoreStorage{}).Put(c, "Delivery", d.Id(), d)
+}
+
+func (datastoreDeliveryStore) Claim(c Context, d *Delivery, status string) (bool, error) {
+	var claimed bool
+	err := datastore.RunInTransaction(aeContextOf(c), func(tc appengine.Context) error {
+		claimed = false
+		key := datastore.NewKey(tc, "Delivery", d.Id(), 0, nil)
+		var old Delivery
+		err := datastore.Get(tc, key, &old)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			if status != "" {
+				return nil
+			}
+		case err != nil:
+			return err
+		case status == "" || old.Status != status || old.Attempts != d.Attempts-1:
+			return nil
+		}
+		if _, err := datastore.Put(tc, key, d); err != nil {
+			return err
+		}
+		claimed = true
+		return nil
+	}, nil)
+	return claimed, err
+}
+
+func (datastoreDeliveryStore) List(c Context, userId string, limit int) ([]*Delivery, error) {
+	var list []*Delivery
+	q := datastore.NewQuery("Delivery").Filter("UserId=", userId).Order("-Updated").Limit(limit)
+	_, err := q.GetAll(aeContextOf(c), &list)
+	return list, err
+}
+
+func (datastoreDeliveryStore) Due(c Context, userId, status string, now time.Time, limit int) ([]*Delivery, error) {
+	var due []*Delivery
+	q := datastore.NewQuery("Delivery").Filter("UserId=", userId).Filter("Status=", status).
+		Filter("NextAttempt<=", now).Order("NextAttempt").Limit(limit)
+	_, err := q.GetAll(aeContextOf(c), &due)
+	return due, err
+}
+
+func (datastoreDeliveryStore) DeleteUser(c Context, userId string) error {
+	ac := aeContextOf(c)
+	keys, err := datastore.NewQuery("Delivery").Filter("UserId=", userId).KeysOnly().GetAll(ac, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ac, keys)
+}
+
+// memcacheCache is App Engine's memcache.
+type memcacheCache struct{}
+
+func (memcacheCache) Get(c Context, key string) ([]byte, error) {
+	item, err := memcache.Get(aeContextOf(c), key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (memcacheCache) Set(c Context, key string, value []byte, ttl time.Duration) error {
+	return memcache.Set(aeContextOf(c), &memcache.Item{Key: key, Value: value, Expiration: ttl})
+}
+
+func (memcacheCache) Add(c Context, key string, value []byte, ttl time.Duration) error {
+	err := memcache.Add(aeContextOf(c), &memcache.Item{Key: key, Value: value, Expiration: ttl})
+	if err == memcache.ErrNotStored {
+		return nil
+	}
+	return err
+}
+
+func (memcacheCache) Delete(c Context, key string) error {
+	err := memcache.Delete(aeContextOf(c), key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
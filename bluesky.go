@@ -0,0 +1,369 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	blueskyHost = "https://bsky.social"
+	// maximum length of a Bluesky post
+	blueskyMaxChars = 300
+	// most images a post can have
+	blueskyMaxPhotos = 4
+)
+
+var blueskyImageLimits = imageLimits{
+	MaxWidth:  2000,
+	MaxHeight: 2000,
+	MaxBytes:  1000000,
+	Formats:   []string{"jpeg", "png"},
+}
+
+var (
+	errBlueskyAuth = errors.New("bluesky: session rejected")
+	// the access token expired, the refresh token may still work
+	errBlueskyExpired = errors.New("bluesky: session expired")
+
+	reBlueskyLink    = regexp.MustCompile(`https?://[^\s]+[^\s.,;:!?)"']`)
+	reBlueskyMention = regexp.MustCompile(`(?:^|\s)(@([a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)+))`)
+)
+
+func init() {
+	registerPublisher(blueskyPublisher{})
+}
+
+// blueskyHandler signs the user in with their handle and an app
+// password. The password itself is never stored, only the session.
+func blueskyHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	if r.Method != "POST" {
+		serve404(w)
+		return
+	}
+	user, err := loadUserCookie(r)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !checkCSRF(r) {
+		serveError(c, w, errCSRF)
+		return
+	}
+
+	handle := strings.TrimPrefix(strings.TrimSpace(r.FormValue("handle")), "@")
+	password := r.FormValue("password")
+	if handle == "" || password == "" {
+		serveError(c, w, errors.New("Missing handle or app password"))
+		return
+	}
+
+	var sess blueskySession
+	in := map[string]string{"identifier": handle, "password": password}
+	if err := blueskyDo(httpClient(c), "POST", "com.atproto.server.createSession", "", in, &sess); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	user.BlueskyDid = sess.Did
+	user.BlueskyHandle = sess.Handle
+	user.BlueskyAccessJwt = sess.AccessJwt
+	user.BlueskyRefreshJwt = sess.RefreshJwt
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func deleteBlueskyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadUserDelete(w, r)
+	if !ok {
+		return
+	}
+	user.DisableBluesky()
+	saveUser(newContext(r), &user)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+type blueskySession struct {
+	Did        string `json:"did"`
+	Handle     string `json:"handle"`
+	AccessJwt  string `json:"accessJwt"`
+	RefreshJwt string `json:"refreshJwt"`
+}
+
+// blueskyFacet marks a range of the text, in UTF-8 bytes, as a link
+// or a mention.
+type blueskyFacet struct {
+	Index struct {
+		ByteStart int `json:"byteStart"`
+		ByteEnd   int `json:"byteEnd"`
+	} `json:"index"`
+	Features []map[string]string `json:"features"`
+}
+
+type blueskyPost struct {
+	Type      string         `json:"$type"`
+	Text      string         `json:"text"`
+	CreatedAt string         `json:"createdAt"`
+	Facets    []blueskyFacet `json:"facets,omitempty"`
+	Embed     interface{}    `json:"embed,omitempty"`
+}
+
+// blueskyPublisher posts activities to Bluesky.
+type blueskyPublisher struct{}
+
+func (blueskyPublisher) Name() string { return "bluesky" }
+
+func (blueskyPublisher) Enabled(user *User) bool {
+	return user.HasBluesky()
+}
+
+func (blueskyPublisher) Publish(c Context, user *User, post *Post) (string, error) {
+	client := httpClient(c)
+
+	act := post.Activity
+	attachment := post.Attachment
+	content := post.Content
+
+	var text string
+	var embed interface{}
+	switch post.Kind {
+	case "status":
+		text = fitText(content, act.Url, blueskyMaxChars, 0, false)
+	case "status_share":
+		if content == "" {
+			content = "Resharing " + act.ActorName
+		}
+		text = fitText(content, act.Url, blueskyMaxChars, 0, true)
+	case "article":
+		if content == attachment.Url {
+			content = ""
+		}
+		text = fitText(content, "", blueskyMaxChars, 0, false)
+		external := map[string]interface{}{
+			"uri":         attachment.Url,
+			"title":       attachment.DisplayName,
+			"description": "",
+		}
+		if attachment.Image != "" {
+			if thumb, err := blueskyUploadImage(c, client, user, attachment.Image); err == nil {
+				external["thumb"] = thumb
+			}
+		}
+		embed = map[string]interface{}{
+			"$type":    "app.bsky.embed.external",
+			"external": external,
+		}
+	case "photo":
+		photos, more := post.photos(blueskyMaxPhotos)
+		var images []map[string]interface{}
+		for _, photo := range photos {
+			blob, err := blueskyUploadImage(c, client, user, photo.Image)
+			if err != nil {
+				if err == errBlueskyAuth {
+					user.DisableBluesky()
+				}
+				return "", err
+			}
+			images = append(images, map[string]interface{}{
+				"alt":   photo.DisplayName,
+				"image": blob,
+			})
+		}
+		text = fitText(content, act.Url, blueskyMaxChars, 0, more)
+		embed = map[string]interface{}{
+			"$type":  "app.bsky.embed.images",
+			"images": images,
+		}
+	default:
+		text = fitText(content, act.ObjectUrl, blueskyMaxChars, 0, true)
+	}
+
+	record := blueskyPost{
+		Type:      "app.bsky.feed.post",
+		Text:      text,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Facets:    blueskyFacets(client, text),
+		Embed:     embed,
+	}
+	in := map[string]interface{}{
+		"repo":       user.BlueskyDid,
+		"collection": "app.bsky.feed.post",
+		"record":     record,
+	}
+	var created struct {
+		Uri string `json:"uri"`
+	}
+	err := blueskyAuthed(c, client, user, func(token string) error {
+		return blueskyDo(client, "POST", "com.atproto.repo.createRecord", token, in, &created)
+	})
+	if err == errBlueskyAuth {
+		user.DisableBluesky()
+	}
+	c.Debugf("blueskyPublisher(%s): err=%v\n", post.Kind, err)
+	return created.Uri, err
+}
+
+// blueskyFacets finds the links and mentions in text. Mentions whose
+// handle can't be resolved are left as plain text.
+func blueskyFacets(client *http.Client, text string) []blueskyFacet {
+	var facets []blueskyFacet
+	for _, m := range reBlueskyLink.FindAllStringIndex(text, -1) {
+		f := blueskyFacet{Features: []map[string]string{{
+			"$type": "app.bsky.richtext.facet#link",
+			"uri":   text[m[0]:m[1]],
+		}}}
+		f.Index.ByteStart, f.Index.ByteEnd = m[0], m[1]
+		facets = append(facets, f)
+	}
+	for _, m := range reBlueskyMention.FindAllStringSubmatchIndex(text, -1) {
+		var out struct {
+			Did string `json:"did"`
+		}
+		q := "com.atproto.identity.resolveHandle?handle=" + url.QueryEscape(text[m[4]:m[5]])
+		if err := blueskyDo(client, "GET", q, "", nil, &out); err != nil || out.Did == "" {
+			continue
+		}
+		f := blueskyFacet{Features: []map[string]string{{
+			"$type": "app.bsky.richtext.facet#mention",
+			"did":   out.Did,
+		}}}
+		f.Index.ByteStart, f.Index.ByteEnd = m[2], m[3]
+		facets = append(facets, f)
+	}
+	return facets
+}
+
+// blueskyUploadImage downloads the image and uploads it as a blob,
+// returning the blob reference to embed in a record.
+func blueskyUploadImage(c Context, client *http.Client, user *User, imageUrl string) (interface{}, error) {
+	media, _, err := fetchImage(c, imageUrl, blueskyImageLimits)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Blob interface{} `json:"blob"`
+	}
+	err = blueskyAuthed(c, client, user, func(token string) error {
+		req, err := http.NewRequest("POST", blueskyHost+"/xrpc/com.atproto.repo.uploadBlob", bytes.NewReader(media))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", http.DetectContentType(media))
+		return blueskySend(client, req, token, &out)
+	})
+	c.Debugf("Uploading %s to Bluesky (%v)\n", imageUrl, err)
+	if err != nil {
+		return nil, err
+	}
+	return out.Blob, nil
+}
+
+// blueskyAuthed calls f with the user's access token, refreshing the
+// session and calling it again if the token expired.
+func blueskyAuthed(c Context, client *http.Client, user *User, f func(token string) error) error {
+	err := f(user.BlueskyAccessJwt)
+	if err != errBlueskyExpired {
+		return err
+	}
+	if err := blueskyRefresh(c, client, user); err != nil {
+		return err
+	}
+	return f(user.BlueskyAccessJwt)
+}
+
+// blueskyRefresh gets the user a new session. Refresh tokens can only
+// be used once, so the new one is saved right away.
+func blueskyRefresh(c Context, client *http.Client, user *User) error {
+	var sess blueskySession
+	err := blueskyDo(client, "POST", "com.atproto.server.refreshSession", user.BlueskyRefreshJwt, nil, &sess)
+	if err == errBlueskyAuth || err == errBlueskyExpired {
+		// another sync may have refreshed it first
+		stored, err := loadUser(c, user.Id)
+		if err == nil && stored.BlueskyRefreshJwt != "" && stored.BlueskyRefreshJwt != user.BlueskyRefreshJwt {
+			user.BlueskyAccessJwt = stored.BlueskyAccessJwt
+			user.BlueskyRefreshJwt = stored.BlueskyRefreshJwt
+			return nil
+		}
+		return errBlueskyAuth
+	}
+	if err != nil {
+		return err
+	}
+	user.BlueskyAccessJwt = sess.AccessJwt
+	user.BlueskyRefreshJwt = sess.RefreshJwt
+	if err := saveUser(c, user); err != nil {
+		c.Errorf("blueskyRefresh(%s): can't save the new session. Err: %v\n", user.Id, err)
+		return err
+	}
+	return nil
+}
+
+// blueskyDo calls an XRPC method, sending in, if not nil, as JSON.
+func blueskyDo(client *http.Client, httpMethod, method, token string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(httpMethod, blueskyHost+"/xrpc/"+method, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return blueskySend(client, req, token, out)
+}
+
+func blueskySend(client *http.Client, req *http.Request, token string, out interface{}) error {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		switch e.Error {
+		case "ExpiredToken":
+			return errBlueskyExpired
+		case "AuthenticationRequired", "InvalidToken":
+			return errBlueskyAuth
+		}
+		err := fmt.Errorf("bluesky: %s: %s %s", resp.Status, e.Error, e.Message)
+		if httpPermanent(resp.StatusCode) {
+			return permanent(err)
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
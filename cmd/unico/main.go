@@ -0,0 +1,43 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+// Command unico runs gplus2others as a standalone server, outside of
+// App Engine. It must be started from the directory holding
+// config.json, templates and static.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	gplus2others "github.com/rselbach/unico"
+)
+
+var (
+	addr     = flag.String("addr", ":8080", "address to listen on")
+	dataDir  = flag.String("data", "data", "directory to store data in")
+	interval = flag.Duration("sync", 3*time.Minute, "how often to sync activities")
+	cacheMB  = flag.Int64("cache", 64, "maximum size of the in-memory cache, in MB")
+	debug    = flag.Bool("debug", false, "enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+	err := gplus2others.ListenAndServe(gplus2others.ServerConfig{
+		Addr:         *addr,
+		DataDir:      *dataDir,
+		SyncInterval: *interval,
+		CacheSize:    *cacheMB << 20,
+		Debug:        *debug,
+		SyncKey:      os.Getenv("UNICO_SYNC_KEY"),
+	})
+	log.Fatal(err)
+}
@@ -7,40 +7,49 @@
 package gplus2others
 
 import (
-	"appengine"
-	"appengine/memcache"
-	"appengine/urlfetch"
-	plus "google.golang.org/api/plus/v1"
 	"errors"
-	"io/ioutil"
 	"net/http"
-	"path"
+	"net/url"
+	"strings"
 	"github.com/robteix/fblib"
 )
 
 func fbHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	id := r.FormValue("id")
-
-	if id == "" {
-		serveError(c, w, errors.New("Missing ID Parameter"))
-		return
-	}
+	c := newContext(r)
 
 	fc := fblib.NewFacebookClient(appConfig.FacebookAppId, appConfig.FacebookAppSecret)
-	fc.Transport = &urlfetch.Transport{Context: c}
+	fc.Transport = c.Transport()
 
+	redirectUrl := "http://" + appConfig.AppHost + "/fb"
 	code := r.FormValue("code")
 	if code == "" {
-
-		http.Redirect(w, r, fc.AuthURL("http://"+appConfig.AppHost+"/fb?id="+id, "offline_access,publish_actions"), http.StatusFound)
+		id := sessionUserId(r)
+		if id == "" {
+			serveError(c, w, errors.New("Not signed in"))
+			return
+		}
+		state, err := newOAuthState(w, r, "facebook", id)
+		if err != nil {
+			serveError(c, w, err)
+			return
+		}
+		authUrl := fc.AuthURL(redirectUrl, "offline_access,publish_actions") + "&state=" + url.QueryEscape(state)
+		http.Redirect(w, r, authUrl, http.StatusFound)
 		return
 	}
 
-	fc.RequestAccessToken(code, "http://"+appConfig.AppHost+"/fb?id="+id)
-	user := loadUser(r, id)
-	if user.Id == "" {
-		serveError(c, w, errors.New("Invalid user ID"))
+	id, err := checkOAuthState(w, r, "facebook", r.FormValue("state"))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	fc.RequestAccessToken(code, redirectUrl)
+	user, err := loadUser(c, id)
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			err = errors.New("Invalid user ID")
+		}
+		serveError(c, w, err)
 		return
 	}
 
@@ -51,97 +60,84 @@ func fbHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	user.FBId = fbuser.Id
 	user.FBName = fbuser.Name
-	saveUser(r, &user)
+	saveUser(c, &user)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 
 }
 
-func publishActivityToFacebook(w http.ResponseWriter, r *http.Request, act *plus.Activity, user *User) {
-	c := appengine.NewContext(r)
+func init() {
+	registerPublisher(facebookPublisher{})
+}
+
+var facebookImageLimits = imageLimits{
+	MaxWidth:  2048,
+	MaxHeight: 2048,
+	MaxBytes:  4 << 20,
+	Formats:   []string{"jpeg", "png", "gif"},
+}
+
+// facebookPublisher posts activities to the user's Facebook wall.
+type facebookPublisher struct{}
+
+func (facebookPublisher) Name() string { return "facebook" }
+
+func (facebookPublisher) Enabled(user *User) bool {
+	return user.HasFacebook()
+}
+
+func (facebookPublisher) Publish(c Context, user *User, post *Post) (string, error) {
 	fc := fblib.NewFacebookClient(appConfig.FacebookAppId, appConfig.FacebookAppSecret)
-	fc.Transport = &urlfetch.Transport{Context: c}
+	fc.Transport = c.Transport()
 	fc.AccessToken = user.FBAccessToken
 
-	_ = w
-
-	var attachment *plus.ActivityObjectAttachments
-	obj := act.Object
-	kind := ""
-	content := ""
-
-	if act.Verb == "share" {
-		content = act.Annotation
-		//if content == "" {
-		//	content = "Resharing " + obj.Actor.DisplayName
-		//}
-		kind = "status_share"
-	} else {
-		kind = "status"
-		if obj != nil {
-			if len(obj.Attachments) > 0 {
-				attachment = obj.Attachments[0]
-				kind = attachment.ObjectType
-			}
-			content = obj.Content
-		} else {
-			content = act.Title
-		}
-
-	}
-	content = removeTags(content)
+	act := post.Activity
+	attachment := post.Attachment
+	content := post.Content
 
 	var err error
 
-	switch kind {
+	switch post.Kind {
 	case "status":
 		// post a status update
 		err = fc.PostStatus(content)
-		return
 	case "photo":
-		// download photo
-		mediaUrl := attachment.FullImage.Url
-		fileName := path.Base(mediaUrl)
+		// the photo itself, the attachment may only be a preview
+		pic := attachment
+		if len(post.Photos) > 0 {
+			pic = post.Photos[0]
+		}
 		var media []byte
-		item, err := memcache.Get(c, "picture"+mediaUrl)
+		var name string
+		media, name, err = fetchImage(c, pic.Image, facebookImageLimits)
 		if err != nil {
-			client := urlfetch.Client(c)
-			resp, err := client.Get(attachment.FullImage.Url)
-			c.Debugf("Downloading %s (%v)\n", mediaUrl, err)
-			if err != nil {
-				break
-			}
-			media, err := ioutil.ReadAll(resp.Body)
-			c.Debugf("Reading contents of %s (%v)\n", mediaUrl, err)
-			if err != nil {
-				break
-			}
-			memcache.Add(c, &memcache.Item{Key: "picture" + mediaUrl, Value: media})
-		} else {
-			media = item.Value
+			break
+		}
+		// only one photo can be posted at a time, so link to
+		// the rest
+		if len(post.Photos) > 1 {
+			content = strings.TrimSpace(content + "\n\n" + act.Url)
 		}
 		// now we post it
 		photo := fblib.Photo{
 			Message:  content,
 			Source:   media,
-			FileName: fileName,
+			FileName: name,
 		}
 		err = fc.PostPhoto(photo)
-		c.Debugf("Posting %s to FB (%v)\n", mediaUrl, err)
+		c.Debugf("Posting %s to FB (%v)\n", pic.Image, err)
 	case "article", "video":
 		// post a link
 		link := fblib.Link{}
 		link.Text = content
 		link.Url = attachment.Url
-		if attachment.FullImage != nil {
-			link.Image = attachment.FullImage.Url
-		}
+		link.Image = attachment.Image
 		err = fc.PostLink(link)
 	default:
-		if obj != nil {
+		if act.ObjectUrl != "" {
 			link := fblib.Link{
 				Text: content,
-				Url:  obj.Url,
+				Url:  act.ObjectUrl,
 			}
 			err = fc.PostLink(link)
 		}
@@ -149,8 +145,8 @@ func publishActivityToFacebook(w http.ResponseWriter, r *http.Request, act *plus
 
 	if err == fblib.ErrOAuth {
 		user.DisableFacebook()
-		saveUser(r, user)
 	}
-	c.Debugf("publishActivityToFacebook(%s): err=%v\n", kind, err)
-
+	c.Debugf("facebookPublisher(%s): err=%v\n", post.Kind, err)
+	// fblib doesn't tell us the id of the post
+	return "", err
 }
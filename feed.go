@@ -0,0 +1,318 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSource(feedSource{})
+}
+
+// largest feed read
+const feedMaxBytes = 4 << 20
+
+var (
+	errFeedURL  = errors.New("Invalid feed URL")
+	errFeedHost = errors.New("Feeds can't be read from that host")
+)
+
+// checkFeedURL makes sure a feed URL is http or https on a public
+// host.
+func checkFeedURL(feedUrl string) error {
+	u, err := url.Parse(feedUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errFeedURL
+	}
+	if !publicHost(u.Hostname()) {
+		return errFeedHost
+	}
+	return nil
+}
+
+// feedHandler sets or clears the RSS/Atom feed the user syncs from.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	if r.Method != "POST" {
+		serve404(w)
+		return
+	}
+
+	user, err := loadUserCookie(r)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !checkCSRF(r) {
+		serveError(c, w, errCSRF)
+		return
+	}
+
+	feedUrl := strings.TrimSpace(r.FormValue("url"))
+	if feedUrl != "" {
+		if err := checkFeedURL(feedUrl); err != nil {
+			serveError(c, w, err)
+			return
+		}
+	}
+
+	if feedUrl != user.FeedURL {
+		user.FeedURL = feedUrl
+		// only entries published from now on are synced
+		user.FeedLatest = time.Now().UnixNano()
+		user.FeedSeen = nil
+	}
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// feedSource reads entries from an RSS 2.0 or Atom feed.
+type feedSource struct{}
+
+func (feedSource) Name() string { return "feed" }
+
+func (feedSource) Linked(user *User) bool {
+	return user.FeedURL != ""
+}
+
+func (feedSource) Latest(user *User) int64 {
+	return user.FeedLatest
+}
+
+func (feedSource) SetLatest(user *User, latest int64) {
+	user.FeedLatest = latest
+}
+
+func (feedSource) Seen(user *User) []string {
+	return user.FeedSeen
+}
+
+func (feedSource) SetSeen(user *User, ids []string) {
+	user.FeedSeen = ids
+}
+
+func (feedSource) Fetch(c Context, user *User) ([]*Activity, error) {
+	// the host may have moved since the URL was saved
+	if err := checkFeedURL(user.FeedURL); err != nil {
+		return nil, fmt.Errorf("feedSource: %s: %v", user.FeedURL, err)
+	}
+	client := httpClient(c)
+	resp, err := client.Get(user.FeedURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feedSource: %s returned %s", user.FeedURL, resp.Status)
+	}
+
+	var doc struct {
+		XMLName xml.Name
+		Channel rssChannel  `xml:"channel"`
+		Entries []atomEntry `xml:"entry"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, feedMaxBytes)).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var acts []*Activity
+	switch doc.XMLName.Local {
+	case "rss":
+		for _, item := range doc.Channel.Items {
+			acts = append(acts, item.activity())
+		}
+	case "feed":
+		for _, entry := range doc.Entries {
+			acts = append(acts, entry.activity())
+		}
+	default:
+		return nil, fmt.Errorf("feedSource: %s is not an RSS or Atom feed", user.FeedURL)
+	}
+
+	// entries without a date we understand can't be compared
+	// against the high-water mark, so they are skipped
+	dated := acts[:0]
+	for _, act := range acts {
+		if act.Published.IsZero() {
+			c.Debugf("feedSource: skipping undated entry %s\n", act.Id)
+			continue
+		}
+		dated = append(dated, act)
+	}
+	return dated, nil
+}
+
+type rssChannel struct {
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Guid        string `xml:"guid"`
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	Encoded     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate     string `xml:"pubDate"`
+	Enclosure   struct {
+		Url  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+func (item *rssItem) activity() *Activity {
+	act := &Activity{
+		Id:      item.Guid,
+		Verb:    "post",
+		Title:   item.Title,
+		Content: item.Encoded,
+		Url:     item.Link,
+	}
+	if act.Id == "" {
+		act.Id = item.Link
+	}
+	if act.Content == "" {
+		act.Content = item.Description
+	}
+	act.Published = parseFeedTime(item.PubDate)
+	switch {
+	case strings.HasPrefix(item.Enclosure.Type, "image/"):
+		act.Attachments = append(act.Attachments, &Attachment{
+			Kind:  "photo",
+			Url:   item.Link,
+			Image: item.Enclosure.Url,
+		})
+	case strings.HasPrefix(item.Enclosure.Type, "video/"):
+		act.Attachments = append(act.Attachments, &Attachment{
+			Kind:        "video",
+			Url:         item.Link,
+			DisplayName: item.Title,
+			Video:       item.Enclosure.Url,
+		})
+	}
+	feedLinkAttachment(act)
+	return act
+}
+
+type atomEntry struct {
+	Id        string   `xml:"id"`
+	Title     string   `xml:"title"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+	Summary   atomText `xml:"summary"`
+	Content   atomText `xml:"content"`
+	Links     []struct {
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+}
+
+// atomText is Atom content or a summary, which is text, escaped HTML
+// or XHTML markup.
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+func (t atomText) html() string {
+	if t.Type == "xhtml" {
+		return strings.TrimSpace(t.Inner)
+	}
+	return t.Text
+}
+
+func (entry *atomEntry) activity() *Activity {
+	act := &Activity{
+		Id:      entry.Id,
+		Verb:    "post",
+		Title:   entry.Title,
+		Content: entry.Content.html(),
+	}
+	if act.Content == "" {
+		act.Content = entry.Summary.html()
+	}
+	published := entry.Published
+	if published == "" {
+		published = entry.Updated
+	}
+	act.Published = parseFeedTime(published)
+
+	for _, l := range entry.Links {
+		switch {
+		case l.Rel == "" || l.Rel == "alternate":
+			if act.Url == "" {
+				act.Url = l.Href
+			}
+		case l.Rel == "enclosure" && strings.HasPrefix(l.Type, "image/"):
+			act.Attachments = append(act.Attachments, &Attachment{
+				Kind:  "photo",
+				Image: l.Href,
+			})
+		case l.Rel == "enclosure" && strings.HasPrefix(l.Type, "video/"):
+			act.Attachments = append(act.Attachments, &Attachment{
+				Kind:        "video",
+				DisplayName: entry.Title,
+				Video:       l.Href,
+			})
+		}
+	}
+	for _, a := range act.Attachments {
+		a.Url = act.Url
+	}
+	if act.Id == "" {
+		act.Id = act.Url
+	}
+	feedLinkAttachment(act)
+	return act
+}
+
+// feedLinkAttachment makes entries without media be published as a
+// link to the entry, which is what people expect from a feed.
+func feedLinkAttachment(act *Activity) {
+	act.ObjectUrl = act.Url
+	if len(act.Attachments) > 0 || act.Url == "" {
+		return
+	}
+	act.Attachments = []*Attachment{{
+		Kind:        "article",
+		Url:         act.Url,
+		DisplayName: act.Title,
+	}}
+}
+
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+}
+
+// parseFeedTime parses the date formats commonly found in feeds. It
+// returns the zero time if none matches.
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,72 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestCheckFeedURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"http://93.184.216.34/feed", nil},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/feed", nil},
+		{"ftp://93.184.216.34/feed", errFeedURL},
+		{"file:///etc/passwd", errFeedURL},
+		{"http:///feed", errFeedURL},
+		{"http://localhost:8080/feed", errFeedHost},
+		{"http://LOCALHOST/feed", errFeedHost},
+		{"http://app.localhost/feed", errFeedHost},
+		{"http://127.0.0.1/feed", errFeedHost},
+		{"http://[::1]/feed", errFeedHost},
+		{"http://10.1.2.3/feed", errFeedHost},
+		{"http://192.168.0.1/feed", errFeedHost},
+		{"http://169.254.169.254/computeMetadata/v1/", errFeedHost},
+		{"http://0.0.0.0/feed", errFeedHost},
+		{"http://[fd00::1]/feed", errFeedHost},
+	}
+	for _, tt := range tests {
+		if got := checkFeedURL(tt.url); got != tt.want {
+			t.Errorf("checkFeedURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestAtomContent(t *testing.T) {
+	tests := []struct {
+		name, entry, want string
+	}{
+		{
+			"html",
+			`<entry><content type="html">&lt;p&gt;Hello &amp;amp; bye&lt;/p&gt;</content></entry>`,
+			"<p>Hello &amp; bye</p>",
+		},
+		{
+			"xhtml",
+			`<entry><content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Hello <b>you</b></p></div></content></entry>`,
+			`<div xmlns="http://www.w3.org/1999/xhtml"><p>Hello <b>you</b></p></div>`,
+		},
+		{
+			"summary",
+			`<entry><summary type="xhtml"> <div>Just <i>this</i></div> </summary></entry>`,
+			"<div>Just <i>this</i></div>",
+		},
+	}
+	for _, tt := range tests {
+		var entry atomEntry
+		if err := xml.Unmarshal([]byte(tt.entry), &entry); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := entry.activity().Content; got != tt.want {
+			t.Errorf("%s: content = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -8,10 +8,11 @@ package gplus2others
 
 import (
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
-	"appengine"
-	"appengine/urlfetch"
 	"code.google.com/p/goauth2/oauth"
 	plus "google.golang.org/api/plus/v1"
 )
@@ -35,18 +36,27 @@ func emptyTransport() *oauth.Transport {
 
 func loginGoogle(w http.ResponseWriter, r *http.Request) {
 	tr := emptyTransport()
-	c := appengine.NewContext(r)
-	tr.Transport = &urlfetch.Transport{Context: c}
-	urls := tr.AuthCodeURL("login")
+	c := newContext(r)
+	tr.Transport = c.Transport()
+	state, err := newOAuthState(w, r, "google", "")
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	urls := tr.AuthCodeURL(state)
 	c.Debugf("Google AuthCodeURL: %s\n", urls)
 	http.Redirect(w, r, urls, http.StatusFound)
 }
 
 func googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	if _, err := checkOAuthState(w, r, "google", r.FormValue("state")); err != nil {
+		serveError(c, w, err)
+		return
+	}
 	code := r.FormValue("code")
 	tr := emptyTransport()
-	tr.Transport = &urlfetch.Transport{Context: c}
+	tr.Transport = c.Transport()
 	if _, err := tr.Exchange(code); err != nil {
 		c.Debugf("tr: %v\n", tr.Token)
 		serveError(c, w, err)
@@ -66,10 +76,17 @@ func googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		serveError(c, w, err)
 		return
 	}
-	cookie := &http.Cookie{Name: "userId", Value: person.Id, Domain: appConfig.AppDomain, Path: "/", MaxAge: 30000000 /* about a year */}
-	http.SetCookie(w, cookie)
+	if err := setSession(w, r, person.Id); err != nil {
+		serveError(c, w, err)
+		return
+	}
 
-	user := loadUser(r, person.Id)
+	// a user we can't read must not be replaced by a new one
+	user, err := loadUser(c, person.Id)
+	if err != nil && err != ErrNoSuchEntity {
+		serveError(c, w, err)
+		return
+	}
 
 	user.GoogleAccessToken = tr.Token.AccessToken
 	user.GoogleTokenExpiry = tr.Token.Expiry.UnixNano()
@@ -77,17 +94,185 @@ func googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	if user.Id == "" {
 		user.Id = person.Id
 		user.GoogleLatest = time.Now().UnixNano()
-
+		user.GoogleSince = user.GoogleLatest
 	}
-	saveUser(r, &user)
+	saveUser(c, &user)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func transport(user User) *oauth.Transport {
 	return &oauth.Transport{
-		Token:     &oauth.Token{AccessToken: user.GoogleAccessToken, RefreshToken: user.GoogleRefreshToken, Expiry: time.Unix(0, user.GoogleTokenExpiry)},
-		Config:    config(appConfig.AppHost),
-		Transport: &urlfetch.Transport{},
+		Token:  &oauth.Token{AccessToken: user.GoogleAccessToken, RefreshToken: user.GoogleRefreshToken, Expiry: time.Unix(0, user.GoogleTokenExpiry)},
+		Config: config(appConfig.AppHost),
+	}
+}
+
+func init() {
+	registerSource(googleSource{})
+}
+
+// activities read per request when syncing
+const googlePageSize = 20
+
+// googleSource reads the user's public Google+ activities.
+type googleSource struct{}
+
+func (googleSource) Name() string { return "google" }
+
+func (googleSource) Linked(user *User) bool {
+	return user.GoogleAccessToken != "" || user.GoogleRefreshToken != ""
+}
+
+func (googleSource) Latest(user *User) int64 {
+	return user.GoogleLatest
+}
+
+func (googleSource) SetLatest(user *User, latest int64) {
+	user.GoogleLatest = latest
+}
+
+func (googleSource) Seen(user *User) []string {
+	return user.GoogleSeen
+}
+
+func (googleSource) SetSeen(user *User, ids []string) {
+	user.GoogleSeen = ids
+}
+
+func (googleSource) Fetch(c Context, user *User) ([]*Activity, error) {
+	tr := transport(*user)
+	tr.Transport = c.Transport()
+
+	p, err := plus.New(tr.Client())
+	if err != nil {
+		return nil, err
+	}
+
+	max := appConfig.SyncMaxActivities
+	if max <= 0 {
+		max = defaultSyncMaxActivities
+	}
+
+	// go back until the newest activity already synced, so that
+	// nothing is missed if there were many since the last sync
+	var acts []*Activity
+	pageToken := ""
+	for {
+		c.Debugf("googleSource: fetching for %s (page %q)\n", user.Id, pageToken)
+		call := p.Activities.List(user.Id, "public").MaxResults(googlePageSize)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		activityFeed, err := call.Do()
+		if err != nil {
+			// a partial list would move the high-water mark past
+			// the activities not read yet
+			return nil, err
+		}
+		caughtUp := false
+		for _, item := range activityFeed.Items {
+			act := plusActivity(item)
+			acts = append(acts, act)
+			caughtUp = caughtUp || act.Published.UnixNano() <= user.GoogleLatest
+		}
+		if caughtUp || activityFeed.NextPageToken == "" {
+			break
+		}
+		if len(acts) >= max {
+			c.Warningf("googleSource: gave up catching up %s after %d activities, older ones are skipped\n", user.Id, len(acts))
+			break
+		}
+		pageToken = activityFeed.NextPageToken
+	}
+
+	// the token may have been refreshed
+	user.GoogleAccessToken = tr.Token.AccessToken
+	user.GoogleRefreshToken = tr.Token.RefreshToken
+	user.GoogleTokenExpiry = tr.Token.Expiry.UnixNano()
+	return acts, nil
+}
+
+// plusActivity converts a Google+ activity to an Activity.
+func plusActivity(item *plus.Activity) *Activity {
+	act := &Activity{
+		Id:         item.Id,
+		Verb:       item.Verb,
+		Title:      item.Title,
+		Annotation: item.Annotation,
+		Url:        item.Url,
+	}
+	act.Published, _ = time.Parse(time.RFC3339, item.Published)
+
+	obj := item.Object
+	if obj == nil {
+		act.Content = item.Title
+		return act
+	}
+	act.Content = obj.Content
+	act.ObjectUrl = obj.Url
+	if obj.Actor != nil {
+		act.ActorName = obj.Actor.DisplayName
+	}
+	for _, a := range obj.Attachments {
+		if a.ObjectType == "album" && len(a.Thumbnails) > 0 {
+			// post the photos of an album rather than a link to it
+			for _, t := range a.Thumbnails {
+				if t.Image == nil {
+					continue
+				}
+				act.Attachments = append(act.Attachments, &Attachment{
+					Kind:        "photo",
+					Url:         t.Url,
+					DisplayName: t.Description,
+					Image:       plusFullSize(t.Image.Url),
+				})
+			}
+			continue
+		}
+		att := &Attachment{
+			Kind:        a.ObjectType,
+			Url:         a.Url,
+			DisplayName: a.DisplayName,
+		}
+		if a.FullImage != nil {
+			att.Image = a.FullImage.Url
+		}
+		if a.Embed != nil && strings.HasPrefix(a.Embed.Type, "video/") {
+			att.Video = a.Embed.Url
+		}
+		act.Attachments = append(act.Attachments, att)
+	}
+	return act
+}
+
+// plusImageSize matches the resizing options of a Google image, like
+// "w300-h200-p" or "s150-c".
+var plusImageSize = regexp.MustCompile(`^[swh][0-9]+(-[a-z0-9]+)*$`)
+
+// plusFullSize returns the URL of the original of a resized Google
+// image, like the thumbnails of an album. Google images take their
+// size either in the last directory of the path or after an "=" at the
+// end, and "s0" is the original size. Other URLs are returned as they
+// are.
+func plusFullSize(imageUrl string) string {
+	u, err := url.Parse(imageUrl)
+	if err != nil || !(strings.HasSuffix(u.Host, ".googleusercontent.com") || strings.HasSuffix(u.Host, ".ggpht.com")) {
+		return imageUrl
+	}
+	if i := strings.LastIndex(u.Path, "="); i >= 0 {
+		if !plusImageSize.MatchString(u.Path[i+1:]) {
+			return imageUrl
+		}
+		u.Path = u.Path[:i] + "=s0"
+		return u.String()
+	}
+	dirs := strings.Split(u.Path, "/")
+	n := len(dirs)
+	if n < 3 || !plusImageSize.MatchString(dirs[n-2]) {
+		return imageUrl
 	}
+	dirs[n-2] = "s0"
+	u.Path = strings.Join(dirs, "/")
+	return u.String()
 }
@@ -0,0 +1,51 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import "testing"
+
+func TestPlusFullSize(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{
+			"https://lh3.googleusercontent.com/-abc/VAbc/AAAA/xyz/w506-h750/photo.jpg",
+			"https://lh3.googleusercontent.com/-abc/VAbc/AAAA/xyz/s0/photo.jpg",
+		},
+		{
+			"https://lh4.googleusercontent.com/-abc/VAbc/AAAA/xyz/s150-c-k/photo.jpg",
+			"https://lh4.googleusercontent.com/-abc/VAbc/AAAA/xyz/s0/photo.jpg",
+		},
+		{
+			"https://lh5.googleusercontent.com/AbCdEf=w300-h200-p",
+			"https://lh5.googleusercontent.com/AbCdEf=s0",
+		},
+		{
+			"https://lh6.ggpht.com/-abc/VAbc/AAAA/xyz/w120/photo.jpg",
+			"https://lh6.ggpht.com/-abc/VAbc/AAAA/xyz/s0/photo.jpg",
+		},
+		// already the original, or no size to change
+		{
+			"https://lh3.googleusercontent.com/-abc/VAbc/AAAA/xyz/photo.jpg",
+			"https://lh3.googleusercontent.com/-abc/VAbc/AAAA/xyz/photo.jpg",
+		},
+		{
+			"https://lh3.googleusercontent.com/AbCdEf",
+			"https://lh3.googleusercontent.com/AbCdEf",
+		},
+		// not Google's
+		{
+			"https://example.com/photos/w300-h200/photo.jpg",
+			"https://example.com/photos/w300-h200/photo.jpg",
+		},
+	}
+	for _, tt := range tests {
+		if got := plusFullSize(tt.url); got != tt.want {
+			t.Errorf("plusFullSize(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -7,17 +7,15 @@
 package gplus2others
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
-	"appengine/urlfetch"
 	"encoding/json"
+	"fmt"
 	plus "google.golang.org/api/plus/v1"
 	"gopkg.in/tweetlib.v2"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sort"
 	"text/template"
-	"time"
 )
 
 var appConfig struct {
@@ -30,6 +28,39 @@ var appConfig struct {
 	AppHost               string
 	AppDomain             string
 	SessionStoreKey       string
+	TokenEncryptionKey    string
+
+	// Keys SessionStoreKey replaced. Sessions sealed with them are
+	// still accepted, and resealed with the current key.
+	OldSessionStoreKeys []string
+
+	// Keys TokenEncryptionKey replaced. Users whose tokens are
+	// encrypted with them are re-encrypted when loaded.
+	OldTokenEncryptionKeys []string
+
+	// Most characters a tweet may have, counted the way Twitter
+	// does. Defaults to 280.
+	TwitterMaxLength int
+
+	// How many users are synced at once, and the most seconds
+	// syncing one may take. Default to 4 and 60.
+	SyncWorkers     int
+	SyncUserTimeout int
+
+	// Most activities read from a source in a sync, when catching
+	// up after many posts or missed syncs. Defaults to 100.
+	SyncMaxActivities int
+
+	// Seconds between posts imported from Google Takeout. Defaults
+	// to 300.
+	ImportInterval int
+
+	// Optional ADN-compatible service (e.g. pnut.io). ADNAPIHost
+	// and ADNAuthURL default to pnut.io's.
+	ADNClientId     string
+	ADNClientSecret string
+	ADNAPIHost      string
+	ADNAuthURL      string
 }
 
 var (
@@ -38,7 +69,10 @@ var (
 		"templates/home.html",
 		"templates/header.html",
 		"templates/footer.html",
-		"templates/error.html")
+		"templates/error.html",
+		"templates/history.html",
+		"templates/takeout.html",
+		"templates/preview.html")
 )
 
 func init() {
@@ -58,7 +92,8 @@ func init() {
 	if appConfig.FacebookAppId == "" || appConfig.FacebookAppSecret == "" ||
 		appConfig.GoogleClientId == "" || appConfig.GoogleClientSecret == "" ||
 		appConfig.TwitterConsumerKey == "" || appConfig.TwitterConsumerSecret == "" ||
-		appConfig.AppHost == "" {
+		appConfig.AppHost == "" || appConfig.SessionStoreKey == "" ||
+		appConfig.TokenEncryptionKey == "" {
 		panic("Invalid configuration")
 	}
 
@@ -67,20 +102,30 @@ func init() {
 	http.HandleFunc("/loginGoogle", loginGoogle)
 	http.HandleFunc("/oauth2callback", googleCallbackHandler)
 	http.HandleFunc("/fb", fbHandler)
+	http.HandleFunc("/mastodon", mastodonHandler)
+	http.HandleFunc("/bluesky", blueskyHandler)
+	http.HandleFunc("/adn", adnHandler)
+	http.HandleFunc("/feed", feedHandler)
 	http.HandleFunc("/sync", syncHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/takeout", takeoutHandler)
+	http.HandleFunc("/preview", previewHandler)
 	http.HandleFunc("/deleteAccount", deleteAccountHandler)
 	http.HandleFunc("/deleteFacebook", deleteFacebookHandler)
 	http.HandleFunc("/deleteTwitter", deleteTwitterHandler)
+	http.HandleFunc("/deleteMastodon", deleteMastodonHandler)
+	http.HandleFunc("/deleteBluesky", deleteBlueskyHandler)
+	http.HandleFunc("/deleteADN", deleteADNHandler)
 
 }
 
+// loadUserCookie loads the user whose session is in the request.
 func loadUserCookie(r *http.Request) (User, error) {
-	userCookie, err := r.Cookie("userId")
-	var user User
-	if err == nil {
-		user = loadUser(r, userCookie.Value)
+	s, _, err := getSession(r)
+	if err != nil {
+		return User{}, err
 	}
-	return user, err
+	return loadUser(newContext(r), s.UserId)
 }
 
 // Displays the home page.
@@ -88,7 +133,7 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	if appConfig.AppHost == "" {
 		appConfig.AppHost = r.Host
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	if r.Method != "GET" || r.URL.Path != "/" {
 		serve404(w)
 		return
@@ -97,16 +142,21 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	params := make(map[string]string)
+	if adnConfigured() {
+		params["adn"] = "on"
+	}
 
-	// Look for a browser cookie containing the user id
+	// Look for a session cookie containing the user id
 	// We can use this to load the user information
+	if token := csrfToken(w, r); token != "" {
+		params["csrf"] = token
+	}
 	var user User
 	user, err := loadUserCookie(r)
 	if err == nil {
 		if user.TwitterId != "" {
 
-			item := new(memcache.Item)
-			item, err := memcache.Get(c, "pic"+user.Id)
+			pic, err := cache.Get(c, "pic"+user.Id)
 
 			if err != nil {
 				// get the user profile pic
@@ -118,7 +168,7 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 					OAuthToken:  user.TwitterOAuthToken}
 				tr := &tweetlib.Transport{Config: conf,
 					Token:     tok,
-					Transport: &urlfetch.Transport{Context: c}}
+					Transport: c.Transport()}
 
 				tl, _ := tweetlib.New(tr.Client())
 				opts := tweetlib.NewOptionals()
@@ -126,24 +176,36 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 				u, err := tl.User.Show(user.TwitterScreenName, opts)
 				if err == nil {
 					params["pic"] = u.ProfileImageUrl
-					memcache.Add(c, &memcache.Item{Key: "pic" + user.Id, Value: []byte(u.ProfileImageUrl)})
+					cache.Add(c, "pic"+user.Id, []byte(u.ProfileImageUrl), twitterPicCacheTTL)
 				}
 
 			} else {
-				params["pic"] = string(item.Value)
+				params["pic"] = string(pic)
 			}
 
 		}
 		params["twitterid"] = user.TwitterId
 		params["twittername"] = user.TwitterScreenName
+		if user.TwitterThread {
+			params["twitterthread"] = "on"
+		}
 		params["googleid"] = user.Id
 		params["fbid"] = user.FBId
 		params["fbname"] = user.FBName
+		params["feedurl"] = user.FeedURL
+		params["mastodonid"] = user.MastodonId
+		params["mastodonname"] = user.MastodonUsername
+		params["mastodoninstance"] = user.MastodonInstance
+		params["mastodonvisibility"] = user.MastodonVisibility
+		params["blueskyid"] = user.BlueskyDid
+		params["blueskyhandle"] = user.BlueskyHandle
+		params["adnid"] = user.ADNId
+		params["adnname"] = user.ADNScreenName
 
 		mu := memUser(c, user.Id)
 		if mu.Name == "" {
 			tr := transport(user)
-			tr.Transport = &urlfetch.Transport{Context: c}
+			tr.Transport = c.Transport()
 			p, _ := plus.New(tr.Client())
 			person, err := p.People.Get(user.Id).Do()
 			if err == nil {
@@ -166,114 +228,114 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func syncHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	q := datastore.NewQuery("User").
-		Filter("Active=", true)
-
-	for t := q.Run(c); ; {
-		var u User
-		_, err := t.Next(&u)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			serveError(c, w, err)
-			return
-		}
-
-		syncStream(w, r, &u)
-	}
-	// schedule next run
-}
-
-func syncStream(w http.ResponseWriter, r *http.Request, user *User) {
-	c := appengine.NewContext(r)
-	tr := transport(*user)
-	tr.Transport = &urlfetch.Transport{Context: c}
-
-	httpClient := tr.Client()
-	p, err := plus.New(httpClient)
-	if err != nil {
-		serveError(c, w, err)
+	if !syncAllowed(r) {
+		serve404(w)
 		return
 	}
-
-	latest := user.GoogleLatest
-	c.Debugf("syncStream: fetching for %s\n", user.Id)
-	activityFeed, err := p.Activities.List(user.Id, "public").MaxResults(5).Do()
+	c := newContext(r)
+	stats, err := syncAll(c)
 	if err != nil {
-		c.Debugf("syncStream: activity fetch failed for %s. Err: %v\n", user.Id, err)
+		serveError(c, w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, stats)
+}
 
-	for _, act := range activityFeed.Items {
-		published, _ := time.Parse(time.RFC3339, act.Published)
-		nPub := published.UnixNano()
-
-		c.Debugf("syncStream: user: %s, nPub: %v, Latest: %v\n", user.Id, nPub, user.GoogleLatest)
+// syncStream reads new activities from every source the user has
+// linked and publishes them to the user's destinations, then sends the
+// deliveries that are due: those that failed before and those queued
+// by an import. It returns the last error reading
+// from a source.
+func syncStream(c Context, user *User) error {
+	before := *user
+	var failed error
+
+	for _, src := range sources {
+		if !src.Linked(user) {
+			continue
+		}
+		acts, err := src.Fetch(c, user)
+		if err != nil {
+			c.Debugf("syncStream: %s fetch failed for %s. Err: %v\n", src.Name(), user.Id, err)
+			failed = err
+			continue
+		}
 
-		baba, _ := json.Marshal(act)
-		c.Debugf("\n\nActivity: %s\n\n", baba)
-		if nPub > user.GoogleLatest {
-			if user.HasFacebook() {
-				publishActivityToFacebook(w, r, act, user)
-			}
-			if user.HasTwitter() {
-				publishActivityToTwitter(w, r, act, user)
+		// oldest first, so that they are published in order
+		sort.SliceStable(acts, func(i, j int) bool {
+			return acts[i].Published.Before(acts[j].Published)
+		})
+
+		latest := src.Latest(user)
+		var retry []string
+		for _, act := range unseen(c, src, user, acts) {
+			if err := publish(c, user, src.Name(), act); err != nil {
+				failed = err
+				retry = append(retry, act.Id)
 			}
 		}
-		if nPub > latest {
-			latest = nPub
+		if len(retry) > 0 {
+			forget(src, user, latest, retry)
 		}
 	}
+	sendDueDeliveries(c, user)
 
-	if latest > user.GoogleLatest ||
-		user.GoogleAccessToken != tr.Token.AccessToken ||
-		user.GoogleRefreshToken != tr.Token.RefreshToken ||
-		user.GoogleTokenExpiry != tr.Token.Expiry.UnixNano() {
-		user.GoogleLatest = latest
-		user.GoogleAccessToken = tr.Token.AccessToken
-		user.GoogleRefreshToken = tr.Token.RefreshToken
-		user.GoogleTokenExpiry = tr.Token.Expiry.UnixNano()
-		saveUser(r, user)
+	if !reflect.DeepEqual(before, *user) {
+		if err := saveUser(c, user); err != nil {
+			c.Errorf("syncStream: can't save %s. Err: %v\n", user.Id, err)
+		}
 	}
+	return failed
 }
 
-func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+// loadUserDelete loads the user for the handlers that delete
+// something, which only take a POST with the CSRF token. If ok is
+// false, the response has been written.
+func loadUserDelete(w http.ResponseWriter, r *http.Request) (user User, ok bool) {
+	if r.Method != "POST" {
+		serve404(w)
+		return user, false
+	}
 	user, err := loadUserCookie(r)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusNotFound)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return user, false
+	}
+	if !checkCSRF(r) {
+		serveError(newContext(r), w, errCSRF)
+		return user, false
+	}
+	return user, true
+}
+
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadUserDelete(w, r)
+	if !ok {
 		return
 	}
 
-	c := appengine.NewContext(r)
-	key := datastore.NewKey(c, "User", user.Id, 0, nil)
-	datastore.Delete(c, key)
-	memUserDelete(c, user.Id)
-	memcache.Delete(c, "user"+user.Id)
-	http.SetCookie(w, &http.Cookie{Name: "userId", Value: "", Domain: appConfig.AppDomain, Path: "/", MaxAge: -1})
+	deleteUser(newContext(r), user.Id)
+	clearSession(w, r)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func deleteTwitterHandler(w http.ResponseWriter, r *http.Request) {
-
-	user, err := loadUserCookie(r)
-	if err == nil {
-		user.DisableTwitter()
-		saveUser(r, &user)
-		http.Redirect(w, r, "/", http.StatusFound)
+	user, ok := loadUserDelete(w, r)
+	if !ok {
+		return
 	}
-	http.Redirect(w, r, "/", http.StatusNotFound)
-
+	user.DisableTwitter()
+	saveUser(newContext(r), &user)
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func deleteFacebookHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := loadUserCookie(r)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusNotFound)
+	user, ok := loadUserDelete(w, r)
+	if !ok {
+		return
 	}
 	user.DisableFacebook()
-	saveUser(r, &user)
+	saveUser(newContext(r), &user)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
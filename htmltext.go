@@ -0,0 +1,296 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// textMode is what htmlToText converts to.
+type textMode int
+
+const (
+	plainText textMode = iota
+	// markdownLinks is Markdown with links and nothing else, for
+	// services like pnut.io that parse only links.
+	markdownLinks
+)
+
+// htmlToText converts the HTML content of an activity to text in the
+// given mode.
+//
+// In plain text, emphasis is kept the way Google+ users type it
+// (*bold*, _italic_, -strike-), and links whose text isn't their
+// target are followed by the target in parentheses. In Markdown, links
+// are written as such, with the brackets in their text escaped, and
+// the rest is left as it is. Mentions and hashtags are kept as text,
+// as they only link back to Google+.
+func htmlToText(s string, mode textMode) string {
+	w := &textWriter{mode: mode}
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return w.String()
+		case html.TextToken:
+			if w.skip == 0 {
+				w.text(z.Token().Data)
+			}
+		case html.StartTagToken:
+			w.start(z.Token())
+		case html.SelfClosingTagToken:
+			tok := z.Token()
+			w.start(tok)
+			w.end(tok)
+		case html.EndTagToken:
+			w.end(z.Token())
+		}
+	}
+}
+
+type textWriter struct {
+	mode    textMode
+	buf     bytes.Buffer
+	space   bool   // whitespace seen since the last word
+	pending string // emphasis to open before the next word
+	skip    int    // inside script or style
+	lists   []int
+	links   []htmlLink
+}
+
+// htmlLink is an <a> being written.
+type htmlLink struct {
+	href  string
+	start int  // where its text starts in buf
+	plain bool // keep just the text
+}
+
+// emphasis markers in plain text
+var textMarkers = map[string]string{
+	"b":      "*",
+	"strong": "*",
+	"i":      "_",
+	"em":     "_",
+	"s":      "-",
+	"strike": "-",
+	"del":    "-",
+}
+
+var (
+	// brackets would end a link's text early
+	markdownEscaper   = strings.NewReplacer(`[`, `\[`, `]`, `\]`)
+	markdownUnescaper = strings.NewReplacer(`\[`, `[`, `\]`, `]`)
+	// parentheses would end a link's target early
+	markdownHref = strings.NewReplacer("(", "%28", ")", "%29")
+)
+
+func (w *textWriter) marker(tag string) string {
+	if w.mode != plainText {
+		return ""
+	}
+	return textMarkers[tag]
+}
+
+// inLink reports whether text is going into a link that will be
+// written as one.
+func (w *textWriter) inLink() bool {
+	return len(w.links) > 0 && !w.links[len(w.links)-1].plain
+}
+
+func (w *textWriter) atLineStart() bool {
+	return w.buf.Len() == 0 || w.buf.Bytes()[w.buf.Len()-1] == '\n'
+}
+
+// word writes s, preceded by a space if whitespace came before it
+// and by any emphasis opened since the last word.
+func (w *textWriter) word(s string) {
+	if w.space && !w.atLineStart() {
+		w.buf.WriteByte(' ')
+	}
+	w.space = false
+	w.buf.WriteString(w.pending)
+	w.pending = ""
+	w.buf.WriteString(s)
+}
+
+// text writes s collapsing whitespace, as a browser would.
+func (w *textWriter) text(s string) {
+	if strings.TrimLeft(s, " \t\r\n") != s {
+		w.space = true
+	}
+	for i, f := range strings.Fields(s) {
+		if i > 0 {
+			w.space = true
+		}
+		// URLs are left alone, to still work if not parsed
+		if w.mode != plainText && w.inLink() && !strings.Contains(f, "://") {
+			f = markdownEscaper.Replace(f)
+		}
+		w.word(f)
+	}
+	if strings.TrimRight(s, " \t\r\n") != s {
+		w.space = true
+	}
+}
+
+// newline ends the current line, leaving n-1 blank lines after it
+// unless there's nothing before it.
+func (w *textWriter) newline(n int) {
+	w.space = false
+	if w.buf.Len() == 0 {
+		return
+	}
+	b := w.buf.Bytes()
+	for i := len(b) - 1; i >= 0 && b[i] == '\n'; i-- {
+		n--
+	}
+	for ; n > 0; n-- {
+		w.buf.WriteByte('\n')
+	}
+}
+
+func (w *textWriter) paragraph() {
+	if w.mode != plainText {
+		w.newline(2)
+	} else {
+		w.newline(1)
+	}
+}
+
+func (w *textWriter) start(tok html.Token) {
+	switch tok.Data {
+	case "br":
+		w.space = false
+		if w.buf.Len() > 0 {
+			w.buf.WriteByte('\n')
+		}
+	case "p", "div", "blockquote":
+		w.paragraph()
+	case "b", "strong", "i", "em", "s", "strike", "del":
+		// opened right before the text, after any space
+		w.pending += w.marker(tok.Data)
+	case "ul":
+		w.lists = append(w.lists, -1)
+		w.newline(1)
+	case "ol":
+		w.lists = append(w.lists, 0)
+		w.newline(1)
+	case "li":
+		w.newline(1)
+		if len(w.lists) == 0 {
+			w.lists = append(w.lists, -1)
+		}
+		w.buf.WriteString(strings.Repeat("  ", len(w.lists)-1))
+		if n := w.lists[len(w.lists)-1]; n < 0 {
+			w.buf.WriteString("- ")
+		} else {
+			w.lists[len(w.lists)-1]++
+			fmt.Fprintf(&w.buf, "%d. ", n+1)
+		}
+	case "a":
+		if w.space && !w.atLineStart() {
+			w.buf.WriteByte(' ')
+		}
+		w.space = false
+		l := htmlLink{href: attr(tok, "href"), start: w.buf.Len()}
+		for _, class := range strings.Fields(attr(tok, "class")) {
+			l.plain = l.plain || class == "proflink" || class == "ot-hashtag"
+		}
+		w.links = append(w.links, l)
+	case "script", "style":
+		w.skip++
+	}
+}
+
+func (w *textWriter) end(tok html.Token) {
+	switch tok.Data {
+	case "p", "div", "blockquote":
+		w.paragraph()
+	case "b", "strong", "i", "em", "s", "strike", "del":
+		m := w.marker(tok.Data)
+		if strings.HasSuffix(w.pending, m) {
+			// nothing was emphasized
+			w.pending = strings.TrimSuffix(w.pending, m)
+			return
+		}
+		// the marker goes right after the text, before any space
+		w.buf.WriteString(m)
+	case "ul", "ol":
+		if len(w.lists) > 0 {
+			w.lists = w.lists[:len(w.lists)-1]
+		}
+		w.newline(1)
+	case "a":
+		if len(w.links) == 0 {
+			return
+		}
+		l := w.links[len(w.links)-1]
+		w.links = w.links[:len(w.links)-1]
+		w.endLink(l)
+	case "script", "style":
+		if w.skip > 0 {
+			w.skip--
+		}
+	}
+}
+
+func (w *textWriter) endLink(l htmlLink) {
+	if l.plain || l.href == "" || !strings.Contains(l.href, "://") {
+		return
+	}
+	text := string(w.buf.Bytes()[l.start:])
+	raw := text
+	if w.mode != plainText {
+		raw = markdownUnescaper.Replace(text)
+	}
+	if raw == "" || sameURL(raw, l.href) {
+		w.buf.Truncate(l.start)
+		w.buf.WriteString(l.href)
+		return
+	}
+	if w.mode != plainText {
+		w.buf.Truncate(l.start)
+		fmt.Fprintf(&w.buf, "[%s](%s)", text, markdownHref.Replace(l.href))
+	} else {
+		fmt.Fprintf(&w.buf, " (%s)", l.href)
+	}
+}
+
+// sameURL reports whether text, the text of a link, is just href,
+// perhaps without the scheme or shortened with an ellipsis.
+func sameURL(text, href string) bool {
+	trim := func(s string) string {
+		for _, p := range []string{"http://", "https://", "www."} {
+			s = strings.TrimPrefix(s, p)
+		}
+		return strings.TrimRight(s, "/")
+	}
+	t, h := trim(text), trim(href)
+	for _, e := range []string{"...", "…"} {
+		if strings.HasSuffix(t, e) {
+			return strings.HasPrefix(h, strings.TrimSuffix(t, e))
+		}
+	}
+	return t == h
+}
+
+func (w *textWriter) String() string {
+	return strings.TrimSpace(w.buf.String())
+}
+
+func attr(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
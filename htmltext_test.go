@@ -0,0 +1,74 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html         string
+		plain, links string
+	}{
+		{
+			"Hello <b>world</b>",
+			"Hello *world*", "Hello world",
+		},
+		{
+			// no space inside the markers
+			"a<b> bold </b>b <i>it</i>, <s>gone</s>",
+			"a *bold* b _it_, -gone-", "a bold b it, gone",
+		},
+		{
+			"<b></b>empty",
+			"empty", "empty",
+		},
+		{
+			// pnut only parses links, so nothing else is escaped
+			"snake_case 2*3 *stars* [brackets] back\\slash",
+			"snake_case 2*3 *stars* [brackets] back\\slash",
+			"snake_case 2*3 *stars* [brackets] back\\slash",
+		},
+		{
+			`read <a href="http://example.com/a_b">the [best] *post*</a>`,
+			"read the [best] *post* (http://example.com/a_b)",
+			`read [the \[best\] *post*](http://example.com/a_b)`,
+		},
+		{
+			`<a href="http://example.com/wiki/Go_(language)">Go</a>`,
+			"Go (http://example.com/wiki/Go_(language))",
+			"[Go](http://example.com/wiki/Go_%28language%29)",
+		},
+		{
+			// links to themselves are left bare, and so are URLs
+			`<a href="http://example.com/a_b">example.com/a_b</a> and http://x.com/c_d`,
+			"http://example.com/a_b and http://x.com/c_d",
+			"http://example.com/a_b and http://x.com/c_d",
+		},
+		{
+			`+<a class="proflink" href="https://plus.google.com/1">Jane_Doe</a> <a class="ot-hashtag" href="https://plus.google.com/s/%23go">#go</a> [sic]`,
+			"+Jane_Doe #go [sic]", "+Jane_Doe #go [sic]",
+		},
+		{
+			"<p>One</p><p>Two<br>Three</p><ul><li>a</li><li>b</li></ul>",
+			"One\nTwo\nThree\n- a\n- b", "One\n\nTwo\nThree\n\n- a\n- b",
+		},
+		{
+			"x<script>alert(1)</script> y",
+			"x y", "x y",
+		},
+	}
+	for _, tt := range tests {
+		for _, m := range []struct {
+			mode textMode
+			want string
+		}{{plainText, tt.plain}, {markdownLinks, tt.links}} {
+			if got := htmlToText(tt.html, m.mode); got != m.want {
+				t.Errorf("htmlToText(%q, %d) = %q, want %q", tt.html, m.mode, got, m.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,444 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageLimits is what a destination accepts for images.
+type imageLimits struct {
+	MaxWidth, MaxHeight int
+	MaxBytes            int
+	// Formats are the formats, as named by the image package,
+	// that can be uploaded as they are.
+	Formats []string
+}
+
+// most pixels an image may have for us to decode it, as decoded
+// images take 4 or 8 bytes a pixel
+const imageMaxPixels = 50 * 1000 * 1000
+
+var (
+	errImageTooLarge = errors.New("image: can't make it small enough")
+	errImagePixels   = errors.New("image: too many pixels")
+)
+
+// fetchImage downloads the image at url and prepares it for a
+// destination with prepareImage. It returns the image and a file name
+// for it.
+func fetchImage(c Context, url string, limits imageLimits) ([]byte, string, error) {
+	data, err := fetchMedia(c, url)
+	if err != nil {
+		return nil, "", err
+	}
+	out, format, err := prepareImage(data, limits)
+	c.Debugf("fetchImage(%s): %d bytes of %s, now %d (%v)\n", url, len(data), format, len(out), err)
+	if err != nil {
+		return nil, "", err
+	}
+	name := path.Base(url)
+	if ext := "." + format; !strings.HasSuffix(strings.ToLower(name), ext) {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	return out, name, nil
+}
+
+// prepareImage makes the image in data acceptable under limits,
+// returning it and its format. Images that are too big are scaled
+// down and those in other formats are converted to JPEG, or PNG if
+// they are transparent. Metadata that can carry the location is
+// removed, by converting the image if need be. Errors that come from
+// the image itself are permanent, as it won't go any better next time.
+func prepareImage(data []byte, limits imageLimits) ([]byte, string, error) {
+	conf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+	ok := len(data) <= limits.MaxBytes &&
+		conf.Width <= limits.MaxWidth && conf.Height <= limits.MaxHeight
+	if ok {
+		for _, f := range limits.Formats {
+			if f != format {
+				continue
+			}
+			if out, ok := stripLocation(data, format); ok {
+				return out, format, nil
+			}
+			break
+		}
+	}
+
+	if int64(conf.Width)*int64(conf.Height) > imageMaxPixels {
+		return nil, "", permanent(errImagePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+	if format == "jpeg" {
+		// the orientation is lost when re-encoding, so apply it
+		img = orientImage(img, jpegOrientation(data))
+	}
+
+	usePNG := !isOpaque(img)
+	for tries := 0; tries < 5; tries++ {
+		img = fitImage(img, limits.MaxWidth, limits.MaxHeight)
+		var buf bytes.Buffer
+		if usePNG {
+			err = png.Encode(&buf, img)
+		} else {
+			err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if buf.Len() <= limits.MaxBytes {
+			if usePNG {
+				return buf.Bytes(), "png", nil
+			}
+			return buf.Bytes(), "jpeg", nil
+		}
+		if usePNG {
+			// JPEG is much smaller, try that first
+			usePNG = false
+			continue
+		}
+		b := img.Bounds()
+		limits.MaxWidth, limits.MaxHeight = b.Dx()*3/4, b.Dy()*3/4
+	}
+	return nil, "", permanent(errImageTooLarge)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
+	}
+	return true
+}
+
+// fitImage scales img down to fit in maxWidth x maxHeight.
+func fitImage(img image.Image, maxWidth, maxHeight int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxWidth && h <= maxHeight {
+		return img
+	}
+	if w*maxHeight > h*maxWidth {
+		w, h = maxWidth, h*maxWidth/w
+	} else {
+		w, h = w*maxHeight/h, maxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// flatten draws img on white, as JPEGs have no transparency.
+func flatten(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// orientImage turns img as the Exif orientation o says it should be
+// shown.
+func orientImage(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotate 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertically
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// stripLocation returns data, an image in format, without the metadata
+// that can carry its location. It returns false if it can't, and the
+// image must be converted instead.
+func stripLocation(data []byte, format string) ([]byte, bool) {
+	switch format {
+	case "jpeg":
+		return jpegStripGPS(data), true
+	case "png":
+		return pngStripMetadata(data)
+	case "webp":
+		return data, !webpHasMetadata(data)
+	}
+	return data, true
+}
+
+// jpegExif returns the Exif data (a TIFF structure) of a JPEG, or nil.
+// It shares memory with data.
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// the image data starts; no more metadata
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil
+		}
+		seg := data[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// exifIFD reads an image file directory in a TIFF structure.
+type exifIFD struct {
+	tiff  []byte
+	order binary.ByteOrder
+	off   int
+}
+
+func exifIFD0(tiff []byte) (exifIFD, bool) {
+	var d exifIFD
+	if len(tiff) < 8 {
+		return d, false
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		d.order = binary.LittleEndian
+	case "MM":
+		d.order = binary.BigEndian
+	default:
+		return d, false
+	}
+	d.tiff = tiff
+	d.off = int(d.order.Uint32(tiff[4:]))
+	return d, d.off+2 <= len(tiff)
+}
+
+func (d exifIFD) count() int {
+	n := int(d.order.Uint16(d.tiff[d.off:]))
+	if max := (len(d.tiff) - d.off - 2) / 12; n > max {
+		n = max
+	}
+	return n
+}
+
+// entry returns the offset of the 12 byte entry for tag, or -1.
+func (d exifIFD) entry(tag uint16) int {
+	for i := 0; i < d.count(); i++ {
+		e := d.off + 2 + 12*i
+		if d.order.Uint16(d.tiff[e:]) == tag {
+			return e
+		}
+	}
+	return -1
+}
+
+const (
+	exifOrientation = 0x0112
+	exifGPSInfo     = 0x8825
+)
+
+// bytes taken by a value of each Exif type
+var exifTypeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// jpegOrientation returns the Exif orientation of a JPEG, 1 (normal)
+// if it has none.
+func jpegOrientation(data []byte) int {
+	d, ok := exifIFD0(jpegExif(data))
+	if !ok {
+		return 1
+	}
+	e := d.entry(exifOrientation)
+	if e < 0 {
+		return 1
+	}
+	return int(d.order.Uint16(d.tiff[e+8:]))
+}
+
+// jpegStripGPS returns a copy of a JPEG with the location data in its
+// Exif blanked out and its XMP metadata, which can have it too,
+// dropped. Everything else is unchanged.
+func jpegStripGPS(data []byte) []byte {
+	data = jpegDropXMP(data)
+	d, ok := exifIFD0(jpegExif(data))
+	if !ok {
+		return data
+	}
+	e := d.entry(exifGPSInfo)
+	if e < 0 {
+		return data
+	}
+	gps := d
+	gps.off = int(d.order.Uint32(d.tiff[e+8:]))
+	if gps.off+2 > len(d.tiff) {
+		return data
+	}
+	for i := 0; i < gps.count(); i++ {
+		e := gps.off + 2 + 12*i
+		size := exifTypeSize[gps.order.Uint16(gps.tiff[e+2:])] * int(gps.order.Uint32(gps.tiff[e+4:]))
+		if size > 4 {
+			// the value is stored elsewhere
+			off := int(gps.order.Uint32(gps.tiff[e+8:]))
+			if off >= 0 && size <= len(gps.tiff)-off {
+				zero(gps.tiff[off : off+size])
+			}
+		}
+		zero(gps.tiff[e : e+12])
+	}
+	gps.order.PutUint16(gps.tiff[gps.off:], 0)
+	return data
+}
+
+// XMP in a JPEG is in APP1 segments starting with one of these.
+var jpegXMPPrefixes = [][]byte{
+	[]byte("http://ns.adobe.com/xap/1.0/\x00"),
+	[]byte("http://ns.adobe.com/xmp/extension/\x00"),
+}
+
+// jpegDropXMP returns a copy of a JPEG without its XMP segments.
+func jpegDropXMP(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return append([]byte(nil), data...)
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+n]
+		xmp := false
+		for _, p := range jpegXMPPrefixes {
+			xmp = xmp || (marker == 0xe1 && bytes.HasPrefix(seg, p))
+		}
+		if !xmp {
+			out = append(out, data[i:i+2+n]...)
+		}
+		i += 2 + n
+	}
+	return append(out, data[i:]...)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG chunks that can carry the location: Exif and text, where XMP
+// goes.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "iTXt": true, "tEXt": true, "zTXt": true}
+
+// pngStripMetadata returns a copy of a PNG without its Exif and text
+// chunks. It returns false if the PNG can't be read.
+func pngStripMetadata(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false
+	}
+	out := append(make([]byte, 0, len(data)), pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, false
+		}
+		n := int64(binary.BigEndian.Uint32(data[i:]))
+		if n > int64(len(data)-i-12) {
+			return nil, false
+		}
+		end := i + 12 + int(n)
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, true
+}
+
+// webpHasMetadata reports whether a WebP has Exif or XMP chunks, or
+// can't be read.
+func webpHasMetadata(data []byte) bool {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return true
+	}
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return true
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+			return true
+		}
+		n := int64(binary.LittleEndian.Uint32(data[i+4:]))
+		if n > int64(len(data)-i-8) {
+			return true
+		}
+		// chunks are padded to an even size
+		i += 8 + int(n+n&1)
+	}
+	return false
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,232 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// testExifJPEG returns the start of a JPEG whose Exif has an
+// orientation and a GPS directory with a latitude, which is too long
+// to fit in its entry and so is stored after the directory.
+func testExifJPEG(order binary.ByteOrder) (data []byte, latitude []byte) {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	put16 := func(v uint16) { binary.Write(&tiff, order, v) }
+	put32 := func(v uint32) { binary.Write(&tiff, order, v) }
+	entry := func(tag, typ uint16, count, value uint32) {
+		put16(tag)
+		put16(typ)
+		put32(count)
+		put32(value)
+	}
+
+	put16(42)
+	put32(8)
+	// IFD0 at 8: orientation and a pointer to the GPS IFD at 38
+	put16(2)
+	if order == binary.LittleEndian {
+		entry(exifOrientation, 3, 1, 6)
+	} else {
+		entry(exifOrientation, 3, 1, 6<<16)
+	}
+	entry(exifGPSInfo, 4, 1, 38)
+	put32(0)
+	// GPS IFD at 38: latitude ref and latitude, whose three
+	// rationals are at 68
+	put16(2)
+	entry(1, 2, 2, uint32(order.Uint16([]byte("N\x00"))))
+	entry(2, 5, 3, 68)
+	put32(0)
+	for _, v := range []uint32{45, 1, 30, 1, 1234, 100} {
+		put32(v)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+	binary.Write(&buf, binary.BigEndian, uint16(2+6+tiff.Len()))
+	buf.WriteString("Exif\x00\x00")
+	buf.Write(tiff.Bytes())
+	buf.Write([]byte{0xff, 0xda, 0x00, 0x02, 0xff, 0xd9})
+	data = buf.Bytes()
+	start := 4 + 2 + 6 + 68
+	return data, data[start : start+24]
+}
+
+func TestJPEGStripGPS(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data, latitude := testExifJPEG(order)
+		orig := append([]byte(nil), data...)
+		lat := append([]byte(nil), latitude...)
+
+		stripped := jpegStripGPS(data)
+		if !bytes.Equal(data, orig) {
+			t.Errorf("%v: jpegStripGPS changed its argument", order)
+		}
+		if len(stripped) != len(orig) {
+			t.Errorf("%v: jpegStripGPS changed the size from %d to %d", order, len(orig), len(stripped))
+		}
+		if bytes.Contains(stripped, lat) {
+			t.Errorf("%v: the latitude is still there", order)
+		}
+		d, ok := exifIFD0(jpegExif(stripped))
+		if !ok {
+			t.Errorf("%v: the Exif can't be read anymore", order)
+			continue
+		}
+		gps := d
+		gps.off = int(d.order.Uint32(d.tiff[d.entry(exifGPSInfo)+8:]))
+		if n := gps.count(); n != 0 {
+			t.Errorf("%v: the GPS directory still has %d entries", order, n)
+		}
+		if o := jpegOrientation(stripped); o != 6 {
+			t.Errorf("%v: orientation is %d, want 6", order, o)
+		}
+	}
+}
+
+func TestJPEGStripGPSInvalid(t *testing.T) {
+	data, _ := testExifJPEG(binary.BigEndian)
+	for _, b := range [][]byte{
+		nil,
+		[]byte("not a jpeg"),
+		{0xff, 0xd8, 0xff, 0xd9},
+		data[:20], // cut inside the Exif
+	} {
+		if got := jpegStripGPS(b); !bytes.Equal(got, b) {
+			t.Errorf("jpegStripGPS(%q) = %q, want it unchanged", b, got)
+		}
+	}
+}
+
+func TestPrepareImageTooManyPixels(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// claim to be 20000x20000 in the header, after the signature
+	data := buf.Bytes()
+	ihdr := data[8:]
+	binary.BigEndian.PutUint32(ihdr[8:], 20000)
+	binary.BigEndian.PutUint32(ihdr[12:], 20000)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+
+	_, _, err := prepareImage(data, twitterImageLimits)
+	if pe, ok := err.(*permanentError); !ok || pe.err != errImagePixels {
+		t.Errorf("prepareImage = %v, want %v, permanent", err, errImagePixels)
+	}
+}
+
+func TestJPEGStripXMP(t *testing.T) {
+	data, latitude := testExifJPEG(binary.BigEndian)
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><rdf:Description exif:GPSLatitude=\"45,30.2N\" exif:GPSLongitude=\"73,34.1W\"/></x:xmpmeta>")
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	buf.Write([]byte{0xff, 0xe1})
+	binary.Write(&buf, binary.BigEndian, uint16(2+len(xmp)))
+	buf.Write(xmp)
+	buf.Write(data[2:])
+
+	stripped := jpegStripGPS(buf.Bytes())
+	if bytes.Contains(stripped, []byte("GPSLatitude")) || bytes.Contains(stripped, []byte("ns.adobe.com")) {
+		t.Errorf("the XMP is still there")
+	}
+	if len(stripped) != len(data) {
+		t.Errorf("stripped JPEG has %d bytes, want %d", len(stripped), len(data))
+	}
+	if bytes.Contains(stripped, latitude) {
+		t.Errorf("the Exif latitude is still there")
+	}
+	if o := jpegOrientation(stripped); o != 6 {
+		t.Errorf("orientation is %d, want 6", o)
+	}
+}
+
+// testPNGChunk returns a PNG chunk.
+func testPNGChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	b = append(b, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc...)
+}
+
+func TestPNGStripMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	// after the signature and IHDR
+	ihdr := 8 + 12 + 13
+	exif, _ := testExifJPEG(binary.BigEndian)
+	data := concat(plain[:ihdr],
+		testPNGChunk("eXIf", exif[12:]),
+		testPNGChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<rdf:Description exif:GPSLatitude=\"45,30.2N\"/>")),
+		testPNGChunk("tEXt", []byte("Comment\x00GPSLatitude 45")),
+		plain[ihdr:])
+
+	out, format, err := prepareImage(data, twitterImageLimits)
+	if err != nil || format != "png" {
+		t.Fatalf("prepareImage = %s, %v", format, err)
+	}
+	for _, s := range []string{"eXIf", "iTXt", "tEXt", "GPSLatitude"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%s is still there", s)
+		}
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf("prepareImage changed more than the metadata")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG can't be decoded: %v", err)
+	}
+
+	if _, ok := pngStripMetadata(plain[:len(plain)-5]); ok {
+		t.Errorf("pngStripMetadata accepted a truncated PNG")
+	}
+}
+
+func TestWebPHasMetadata(t *testing.T) {
+	riff := func(chunks ...[]byte) []byte {
+		body := concat(append([][]byte{[]byte("WEBP")}, chunks...)...)
+		b := append([]byte("RIFF"), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+		return append(b, body...)
+	}
+	chunk := func(typ string, n int) []byte {
+		b := append([]byte(typ), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[4:], uint32(n))
+		return append(b, make([]byte, n+n&1)...)
+	}
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"plain", riff(chunk("VP8X", 10), chunk("VP8L", 5)), false},
+		{"exif", riff(chunk("VP8X", 10), chunk("VP8L", 5), chunk("EXIF", 30)), true},
+		{"xmp", riff(chunk("VP8X", 10), chunk("XMP ", 7), chunk("VP8L", 5)), true},
+		{"truncated", riff(chunk("VP8X", 10), chunk("VP8L", 5))[:34], true},
+		{"not webp", []byte("RIFF\x00\x00\x00\x00WAVE"), true},
+	} {
+		if got := webpHasMetadata(tt.data); got != tt.want {
+			t.Errorf("%s: webpHasMetadata = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Delivery records sending an activity to one of a user's
+// destinations, so that it is sent only once and the user can see
+// what happened to it.
+type Delivery struct {
+	UserId     string
+	Publisher  string
+	Source     string
+	ActivityId string
+
+	Status string
+	// RemoteId is the id the destination gave the post, if known.
+	RemoteId string
+	Error    string `datastore:",noindex"`
+	Attempts int
+	// NextAttempt is when a failed delivery is retried.
+	NextAttempt time.Time
+
+	// Activity is the activity as JSON, kept until it is delivered
+	// so that it can be retried.
+	Activity []byte `datastore:",noindex"`
+
+	Created time.Time
+	Updated time.Time
+}
+
+// Delivery statuses
+const (
+	// being published; if it stays this way, publishing was
+	// interrupted and the post may or may not be there
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	// failed, to be retried at NextAttempt
+	deliveryFailed = "failed"
+	// imported, to be sent at NextAttempt
+	deliveryQueued = "queued"
+	// failed for good, or too many times
+	deliveryDead = "dead"
+)
+
+// Failed deliveries are retried, waiting twice as long after every
+// attempt from retryMinWait up to retryMaxWait, until they have been
+// attempted deliveryMaxAttempts times.
+const (
+	deliveryMaxAttempts = 8
+	retryMinWait        = time.Minute
+	retryMaxWait        = 6 * time.Hour
+
+	// most deliveries retried or sent from the queue for a user in
+	// a sync
+	retryBatch = 10
+
+	// a delivery still pending after this long was interrupted, and
+	// is retried
+	deliveryPendingTimeout = 30 * time.Minute
+)
+
+// deliveryHistory is how many deliveries /history shows.
+const deliveryHistory = 50
+
+// DeliveryStore keeps Delivery records.
+type DeliveryStore interface {
+	// Get returns ErrNoSuchEntity if there is no delivery with that id.
+	Get(c Context, id string) (*Delivery, error)
+	Put(c Context, d *Delivery) error
+	// Claim stores d unless another sync got to it first, reporting
+	// whether it did. If status is "", d must be new; otherwise the
+	// stored delivery must still have status and one attempt less
+	// than d.
+	Claim(c Context, d *Delivery, status string) (bool, error)
+	// List returns the user's latest deliveries, most recently
+	// updated first.
+	List(c Context, userId string, limit int) ([]*Delivery, error)
+	// Due returns the user's deliveries with status whose
+	// NextAttempt is not after now, oldest first.
+	Due(c Context, userId, status string, now time.Time, limit int) ([]*Delivery, error)
+	// DeleteUser deletes every delivery of the user.
+	DeleteUser(c Context, userId string) error
+}
+
+// deliveries is set up by the platform.
+var deliveries DeliveryStore
+
+// deliveryId identifies the delivery of an activity to a publisher.
+// Activity ids can be long (feeds often use URLs), so they are hashed.
+func deliveryId(userId, publisher, source, activityId string) string {
+	h := sha1.Sum([]byte(source + "\x00" + activityId))
+	return userId + ":" + publisher + ":" + hex.EncodeToString(h[:])
+}
+
+func (d *Delivery) Id() string {
+	return deliveryId(d.UserId, d.Publisher, d.Source, d.ActivityId)
+}
+
+// publish sends the activity to every publisher the user has enabled
+// that it hasn't been sent to yet, recording each delivery. It returns
+// an error if a delivery couldn't be recorded, and so wasn't made; the
+// activity must then be synced again.
+func publish(c Context, user *User, source string, act *Activity) error {
+	post := newPost(act)
+	var failed error
+	for _, p := range publishers {
+		if !p.Enabled(user) {
+			continue
+		}
+
+		d := &Delivery{
+			UserId:     user.Id,
+			Publisher:  p.Name(),
+			Source:     source,
+			ActivityId: act.Id,
+			Created:    time.Now(),
+		}
+		var err error
+		if d.Activity, err = json.Marshal(act); err != nil {
+			c.Errorf("publish: can't encode %s. Err: %v\n", act.Id, err)
+			continue
+		}
+		ok, err := claimDelivery(c, d, "")
+		if err != nil {
+			// better not to publish than to publish twice
+			c.Errorf("publish: can't record delivery %s. Err: %v\n", d.Id(), err)
+			failed = err
+			continue
+		}
+		if !ok {
+			c.Debugf("publish: %s already sent to %s for %s\n", act.Id, p.Name(), user.Id)
+			continue
+		}
+		deliver(c, user, p, d, post)
+	}
+	return failed
+}
+
+// claimDelivery marks d, which had status ("" if it is new), as
+// pending for another attempt, unless another sync got to it first.
+func claimDelivery(c Context, d *Delivery, status string) (bool, error) {
+	d.Status = deliveryPending
+	d.Attempts++
+	d.Updated = time.Now()
+	d.NextAttempt = d.Updated.Add(deliveryPendingTimeout)
+	return deliveries.Claim(c, d, status)
+}
+
+// deliver makes an attempt at publishing post as d, once claimed, and
+// records how it went. Failures are retried later unless they are
+// permanent.
+func deliver(c Context, user *User, p Publisher, d *Delivery, post *Post) {
+	remoteId, err := p.Publish(c, user, post)
+	d.Updated = time.Now()
+	switch {
+	case err == nil:
+		d.Status = deliveryDelivered
+		d.RemoteId = remoteId
+		d.Error = ""
+		d.Activity = nil
+	case isPermanent(err) || !p.Enabled(user) || d.Attempts >= deliveryMaxAttempts:
+		// a publisher disables itself when it loses access
+		c.Warningf("deliver: %s gave up on %s for %s after %d attempts. Err: %v\n",
+			p.Name(), d.ActivityId, user.Id, d.Attempts, err)
+		d.Status = deliveryDead
+		d.Error = err.Error()
+	default:
+		c.Debugf("deliver: %s failed for %s. Err: %v\n", p.Name(), user.Id, err)
+		d.Status = deliveryFailed
+		d.Error = err.Error()
+		d.NextAttempt = d.Updated.Add(retryWait(d.Attempts))
+	}
+	if err := deliveries.Put(c, d); err != nil {
+		// it stays pending, and is retried when that times out
+		c.Errorf("deliver: can't record delivery %s. Err: %v\n", d.Id(), err)
+	}
+}
+
+// retryWait is how long to wait before retrying a delivery that has
+// failed attempts times. It is jittered so that posts that failed
+// together, e.g. while a destination was down, aren't all retried at
+// once.
+func retryWait(attempts int) time.Duration {
+	wait := retryMaxWait
+	if attempts < 30 {
+		if w := retryMinWait << uint(attempts-1); w < wait {
+			wait = w
+		}
+	}
+	// somewhere between half and all of it
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+var errDeliveryDisabled = errors.New("delivery: destination was disconnected")
+
+// sendDueDeliveries retries the user's failed and interrupted
+// deliveries and sends the queued ones whose time has come.
+func sendDueDeliveries(c Context, user *User) {
+	var due []*Delivery
+	for _, status := range []string{deliveryFailed, deliveryPending, deliveryQueued} {
+		list, err := deliveries.Due(c, user.Id, status, time.Now(), retryBatch-len(due))
+		if err != nil {
+			c.Errorf("sendDueDeliveries: can't list deliveries of %s. Err: %v\n", user.Id, err)
+			return
+		}
+		due = append(due, list...)
+		if len(due) >= retryBatch {
+			break
+		}
+	}
+	for _, d := range due {
+		p := publishersByName[d.Publisher]
+		act := new(Activity)
+		err := json.Unmarshal(d.Activity, act)
+		if err == nil && (p == nil || !p.Enabled(user)) {
+			err = errDeliveryDisabled
+		}
+		if err != nil {
+			c.Debugf("sendDueDeliveries: giving up on %s. Err: %v\n", d.Id(), err)
+			d.Status = deliveryDead
+			d.Error = err.Error()
+			d.Updated = time.Now()
+			if err := deliveries.Put(c, d); err != nil {
+				c.Errorf("sendDueDeliveries: can't record delivery %s. Err: %v\n", d.Id(), err)
+			}
+			continue
+		}
+		c.Debugf("sendDueDeliveries: %s to %s for %s, attempt %d\n", d.ActivityId, d.Publisher, user.Id, d.Attempts+1)
+		ok, err := claimDelivery(c, d, d.Status)
+		if err != nil {
+			c.Errorf("sendDueDeliveries: can't record delivery %s. Err: %v\n", d.Id(), err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		deliver(c, user, p, d, newPost(act))
+	}
+}
+
+// historyHandler shows the user's latest deliveries.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	user, err := loadUserCookie(r)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	list, err := deliveries.List(c, user.Id, deliveryHistory)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "history", list)
+}
@@ -0,0 +1,113 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a Cache that lives in the process memory. When the
+// values take more than maxBytes, the least recently used are evicted.
+type lruCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (lc *lruCache) Get(c Context, key string) ([]byte, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	e, ok := lc.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		lc.remove(e)
+		return nil, ErrCacheMiss
+	}
+	lc.ll.MoveToFront(e)
+	return entry.value, nil
+}
+
+func (lc *lruCache) Set(c Context, key string, value []byte, ttl time.Duration) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if e, ok := lc.items[key]; ok {
+		lc.remove(e)
+	}
+	lc.add(key, value, ttl)
+	return nil
+}
+
+func (lc *lruCache) Add(c Context, key string, value []byte, ttl time.Duration) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if e, ok := lc.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			return nil
+		}
+		lc.remove(e)
+	}
+	lc.add(key, value, ttl)
+	return nil
+}
+
+func (lc *lruCache) Delete(c Context, key string) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if e, ok := lc.items[key]; ok {
+		lc.remove(e)
+	}
+	return nil
+}
+
+// add inserts a new entry and evicts old ones until we are back under
+// maxBytes. A value bigger than maxBytes is not cached at all. Must be
+// called with lc.mu held.
+func (lc *lruCache) add(key string, value []byte, ttl time.Duration) {
+	size := int64(len(key) + len(value))
+	if size > lc.maxBytes {
+		return
+	}
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	lc.items[key] = lc.ll.PushFront(entry)
+	lc.bytes += size
+	for lc.bytes > lc.maxBytes {
+		lc.remove(lc.ll.Back())
+	}
+}
+
+// remove must be called with lc.mu held.
+func (lc *lruCache) remove(e *list.Element) {
+	entry := lc.ll.Remove(e).(*lruEntry)
+	delete(lc.items, entry.key)
+	lc.bytes -= int64(len(entry.key) + len(entry.value))
+}
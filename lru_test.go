@@ -0,0 +1,83 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := testContext{t}
+	// room for three one byte keys with one byte values
+	lc := newLRUCache(6)
+	lc.Set(c, "a", []byte("1"), 0)
+	lc.Set(c, "b", []byte("2"), 0)
+	lc.Set(c, "c", []byte("3"), 0)
+	// a is now used more recently than b
+	if v, err := lc.Get(c, "a"); err != nil || string(v) != "1" {
+		t.Fatalf("Get(a) = %q, %v, want 1", v, err)
+	}
+	lc.Set(c, "d", []byte("4"), 0)
+
+	for key, want := range map[string]string{"a": "1", "b": "", "c": "3", "d": "4"} {
+		v, err := lc.Get(c, key)
+		if want == "" {
+			if err != ErrCacheMiss {
+				t.Errorf("Get(%s) = %q, %v, want it evicted", key, v, err)
+			}
+			continue
+		}
+		if err != nil || string(v) != want {
+			t.Errorf("Get(%s) = %q, %v, want %s", key, v, err, want)
+		}
+	}
+	if lc.bytes != 6 {
+		t.Errorf("%d bytes cached, want 6", lc.bytes)
+	}
+
+	// too big for the cache, and leaves it alone
+	lc.Set(c, "e", []byte("too big"), 0)
+	if _, err := lc.Get(c, "e"); err != ErrCacheMiss {
+		t.Errorf("Get(e) = %v, want a miss", err)
+	}
+	if _, err := lc.Get(c, "d"); err != nil {
+		t.Errorf("Get(d) = %v after a value too big", err)
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := testContext{t}
+	lc := newLRUCache(100)
+	lc.Set(c, "short", []byte("1"), 10*time.Millisecond)
+	lc.Set(c, "forever", []byte("2"), 0)
+
+	// Add doesn't replace a live entry
+	lc.Add(c, "short", []byte("x"), time.Hour)
+	if v, err := lc.Get(c, "short"); err != nil || string(v) != "1" {
+		t.Errorf("Get(short) = %q, %v, want 1", v, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := lc.Get(c, "short"); err != ErrCacheMiss {
+		t.Errorf("Get(short) = %v after it expired, want a miss", err)
+	}
+	if lc.bytes != int64(len("forever")+1) {
+		t.Errorf("%d bytes cached, want the expired entry's freed", lc.bytes)
+	}
+	if _, err := lc.Get(c, "forever"); err != nil {
+		t.Errorf("Get(forever) = %v", err)
+	}
+
+	// but does replace an expired one
+	lc.Set(c, "short", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	lc.Add(c, "short", []byte("3"), 0)
+	if v, err := lc.Get(c, "short"); err != nil || string(v) != "3" {
+		t.Errorf("Get(short) = %q, %v after Add, want 3", v, err)
+	}
+}
@@ -0,0 +1,461 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maximum length of a Mastodon status
+	mastodonMaxChars = 500
+	// Mastodon counts every URL as this many characters
+	mastodonUrlLength = 23
+	// most media a status can have
+	mastodonMaxPhotos = 4
+	mastodonScopes    = "read:accounts write:statuses write:media"
+
+	// how long to wait for the instance to process uploaded media,
+	// and how often to check
+	mastodonMediaTimeout = 30 * time.Second
+	mastodonMediaPoll    = time.Second
+)
+
+var mastodonImageLimits = imageLimits{
+	MaxWidth:  3840,
+	MaxHeight: 3840,
+	MaxBytes:  8 << 20,
+	Formats:   []string{"jpeg", "png", "gif", "webp"},
+}
+
+var (
+	errMastodonAuth     = errors.New("mastodon: access token rejected")
+	errMastodonMedia    = errors.New("mastodon: timed out waiting for media to be processed")
+	errMastodonInstance = errors.New("Invalid Mastodon instance")
+)
+
+// mastodonVisibilities are the visibilities a user can choose from.
+var mastodonVisibilities = []string{"public", "unlisted", "private"}
+
+func init() {
+	registerPublisher(mastodonPublisher{})
+}
+
+// MastodonApp holds the client credentials of the app we registered on
+// a Mastodon instance. They are stored keyed by the
+// instance host name, so each instance is registered only once.
+type MastodonApp struct {
+	Instance     string
+	ClientId     string
+	ClientSecret string
+}
+
+func mastodonHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("action") {
+	case "init":
+		signInMastodonHandler(w, r)
+	case "callback":
+		mastodonCallback(w, r)
+	case "visibility":
+		mastodonVisibilityHandler(w, r)
+	default:
+		c := newContext(r)
+		serveError(c, w, errors.New("Invalid Action Parameter"))
+	}
+}
+
+// mastodonInstance normalizes what the user typed as their instance,
+// accepting things like "https://mastodon.social/" or "@me@mastodon.social".
+func mastodonInstance(s string) (string, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+	s = strings.TrimPrefix(s, "https://")
+	s = strings.TrimPrefix(s, "http://")
+	s = strings.TrimRight(s, "/")
+	// a host name, without a port
+	if !strings.Contains(s, ".") || strings.TrimLeft(s, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+		return "", errMastodonInstance
+	}
+	return s, nil
+}
+
+// mastodonFlow is the OAuth flow of signing in on instance, so that the
+// callback can't be pointed at another one.
+func mastodonFlow(instance string) string {
+	return "mastodon " + instance
+}
+
+func mastodonRedirectURL(instance string) string {
+	return "http://" + appConfig.AppHost + "/mastodon?action=callback&instance=" + url.QueryEscape(instance)
+}
+
+// mastodonAppFor returns our app credentials on the instance,
+// registering the app there if this is the first time we see it.
+func mastodonAppFor(c Context, instance string) (*MastodonApp, error) {
+	app := new(MastodonApp)
+	err := storage.Get(c, "MastodonApp", instance, app)
+	if err == nil {
+		return app, nil
+	}
+	if err != ErrNoSuchEntity {
+		return nil, err
+	}
+	// nothing is stored for hosts we can't register on
+	if !publicHost(instance) {
+		return nil, errMastodonInstance
+	}
+
+	form := url.Values{
+		"client_name":   {"Unico"},
+		"redirect_uris": {mastodonRedirectURL(instance)},
+		"scopes":        {mastodonScopes},
+		"website":       {"http://" + appConfig.AppHost},
+	}
+	var resp struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	client := httpClient(c)
+	if err := mastodonDo(client, "POST", "https://"+instance+"/api/v1/apps", "", form, &resp); err != nil {
+		return nil, err
+	}
+	app.Instance = instance
+	app.ClientId = resp.ClientId
+	app.ClientSecret = resp.ClientSecret
+	if err := storage.Put(c, "MastodonApp", instance, app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func signInMastodonHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	id := sessionUserId(r)
+	if id == "" {
+		serveError(c, w, errors.New("Not signed in"))
+		return
+	}
+	instance, err := mastodonInstance(r.FormValue("instance"))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	app, err := mastodonAppFor(c, instance)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	state, err := newOAuthState(w, r, mastodonFlow(instance), id)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	q := url.Values{
+		"client_id":     {app.ClientId},
+		"redirect_uri":  {mastodonRedirectURL(instance)},
+		"response_type": {"code"},
+		"scope":         {mastodonScopes},
+		"state":         {state},
+	}
+	http.Redirect(w, r, "https://"+instance+"/oauth/authorize?"+q.Encode(), http.StatusFound)
+}
+
+func mastodonCallback(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	instance, err := mastodonInstance(r.FormValue("instance"))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	// the state is only good for the instance the flow started on
+	id, err := checkOAuthState(w, r, mastodonFlow(instance), r.FormValue("state"))
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		serveError(c, w, errors.New("Missing code parameter"))
+		return
+	}
+	app, err := mastodonAppFor(c, instance)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	client := httpClient(c)
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {app.ClientId},
+		"client_secret": {app.ClientSecret},
+		"redirect_uri":  {mastodonRedirectURL(instance)},
+		"scope":         {mastodonScopes},
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := mastodonDo(client, "POST", "https://"+instance+"/oauth/token", "", form, &tok); err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	var account struct {
+		Id       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := mastodonDo(client, "GET", "https://"+instance+"/api/v1/accounts/verify_credentials", tok.AccessToken, nil, &account); err != nil {
+		serveError(c, w, err)
+		return
+	}
+
+	user, err := loadUser(c, id)
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			err = errors.New("Invalid user ID")
+		}
+		serveError(c, w, err)
+		return
+	}
+	user.MastodonInstance = instance
+	user.MastodonAccessToken = tok.AccessToken
+	user.MastodonId = account.Id
+	user.MastodonUsername = account.Username
+	if user.MastodonVisibility == "" {
+		user.MastodonVisibility = "public"
+	}
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func mastodonVisibilityHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	user, err := loadUserCookie(r)
+	if err != nil || !user.HasMastodon() {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if r.Method != "POST" || !checkCSRF(r) {
+		serveError(c, w, errCSRF)
+		return
+	}
+	visibility := r.FormValue("visibility")
+	valid := false
+	for _, v := range mastodonVisibilities {
+		valid = valid || v == visibility
+	}
+	if !valid {
+		serveError(c, w, errors.New("Invalid visibility"))
+		return
+	}
+	user.MastodonVisibility = visibility
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func deleteMastodonHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadUserDelete(w, r)
+	if !ok {
+		return
+	}
+	user.DisableMastodon()
+	saveUser(newContext(r), &user)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// mastodonPublisher posts activities as Mastodon statuses.
+type mastodonPublisher struct{}
+
+func (mastodonPublisher) Name() string { return "mastodon" }
+
+func (mastodonPublisher) Enabled(user *User) bool {
+	return user.HasMastodon()
+}
+
+func (mastodonPublisher) Publish(c Context, user *User, post *Post) (string, error) {
+	client := httpClient(c)
+	base := "https://" + user.MastodonInstance
+
+	act := post.Activity
+	attachment := post.Attachment
+	content := post.Content
+
+	form := url.Values{}
+	switch post.Kind {
+	case "status":
+		form.Set("status", fitText(content, act.Url, mastodonMaxChars, mastodonUrlLength, false))
+	case "status_share":
+		if content == "" {
+			content = "Resharing " + act.ActorName
+		}
+		form.Set("status", fitText(content, act.Url, mastodonMaxChars, mastodonUrlLength, true))
+	case "article":
+		if content == attachment.Url || content == "" {
+			content = attachment.DisplayName
+		}
+		form.Set("status", fitText(content, attachment.Url, mastodonMaxChars, mastodonUrlLength, true))
+	case "photo":
+		photos, more := post.photos(mastodonMaxPhotos)
+		for _, photo := range photos {
+			media, name, err := fetchImage(c, photo.Image, mastodonImageLimits)
+			if err != nil {
+				return "", err
+			}
+			var m mastodonMedia
+			err = mastodonUpload(client, base+"/api/v2/media", user.MastodonAccessToken, name, media, &m)
+			if err == nil {
+				err = mastodonWaitMedia(c, client, base, user.MastodonAccessToken, &m)
+			}
+			c.Debugf("Uploading %s to Mastodon (%v)\n", photo.Image, err)
+			if err != nil {
+				if err == errMastodonAuth {
+					user.DisableMastodon()
+				}
+				return "", err
+			}
+			form.Add("media_ids[]", m.Id)
+		}
+		form.Set("status", fitText(content, act.Url, mastodonMaxChars, mastodonUrlLength, more))
+	default:
+		form.Set("status", fitText(content, act.ObjectUrl, mastodonMaxChars, mastodonUrlLength, true))
+	}
+
+	var err error
+	var status struct {
+		Id string `json:"id"`
+	}
+	if form.Get("status") != "" || form.Get("media_ids[]") != "" {
+		visibility := user.MastodonVisibility
+		if visibility == "" {
+			visibility = "public"
+		}
+		form.Set("visibility", visibility)
+		err = mastodonDo(client, "POST", base+"/api/v1/statuses", user.MastodonAccessToken, form, &status)
+	}
+
+	if err == errMastodonAuth {
+		user.DisableMastodon()
+	}
+	c.Debugf("mastodonPublisher(%s): err=%v\n", post.Kind, err)
+	return status.Id, err
+}
+
+// mastodonDo calls the Mastodon API, decoding the JSON response into v
+// if it is not nil. form, if not nil, is sent url-encoded.
+func mastodonDo(client *http.Client, method, u, token string, form url.Values, v interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return mastodonSend(client, req, token, v)
+}
+
+// mastodonMedia is an uploaded media file.
+type mastodonMedia struct {
+	Id string `json:"id"`
+	// Url is null until the instance has processed the file.
+	Url string `json:"url"`
+}
+
+// mastodonWaitMedia waits until the instance has processed m, which it
+// may do in the background (answering the upload with 202 Accepted).
+// Statuses can't use it until then. It gives up when the sync must end.
+func mastodonWaitMedia(c Context, client *http.Client, base, token string, m *mastodonMedia) error {
+	deadline := time.Now().Add(mastodonMediaTimeout)
+	if d, ok := syncDeadline(c); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for m.Url == "" {
+		if time.Now().Add(mastodonMediaPoll).After(deadline) {
+			return errMastodonMedia
+		}
+		time.Sleep(mastodonMediaPoll)
+		// 206 Partial Content while still processing
+		err := mastodonDo(client, "GET", base+"/api/v1/media/"+url.PathEscape(m.Id), token, nil, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mastodonUpload uploads a media file.
+func mastodonUpload(client *http.Client, u, token, fileName string, data []byte, v interface{}) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		return err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return mastodonSend(client, req, token, v)
+}
+
+func mastodonSend(client *http.Client, req *http.Request, token string, v interface{}) error {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errMastodonAuth
+	case resp.StatusCode >= 300:
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		err := fmt.Errorf("mastodon: %s: %s", resp.Status, e.Error)
+		if httpPermanent(resp.StatusCode) {
+			return permanent(err)
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
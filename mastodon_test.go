@@ -0,0 +1,31 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import "testing"
+
+func TestMastodonInstance(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"mastodon.social", "mastodon.social"},
+		{" https://Mastodon.Social/ ", "mastodon.social"},
+		{"@me@hachyderm.io", "hachyderm.io"},
+		{"mastodon.social:8443", ""},
+		{"mastodon.social/@me", ""},
+		{"evil.com?x=mastodon.social", ""},
+		{"localhost", ""},
+		{"mast_odon.social", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := mastodonInstance(tt.in)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("mastodonInstance(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	oauthStateCookie   = "oauthstate"
+	oauthStateLifetime = 15 * time.Minute
+)
+
+var errOAuthState = errors.New("Sign in expired or was started elsewhere, please try again")
+
+// oauthState ties an OAuth flow to the browser and the session that
+// started it, so that a callback can only complete a flow the same
+// user started, and only once.
+type oauthState struct {
+	Flow    string // "google", "twitter", "mastodon <instance>", ...
+	State   string
+	UserId  string // signed in user, "" for the Google login
+	Expires int64
+}
+
+// newOAuthState starts an OAuth flow, returning a random state to
+// send to the provider.
+func newOAuthState(w http.ResponseWriter, r *http.Request, flow, userId string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	return state, setOAuthState(w, r, flow, userId, state)
+}
+
+// setOAuthState starts an OAuth flow with a state chosen by the
+// provider, like Twitter's temporary token.
+func setOAuthState(w http.ResponseWriter, r *http.Request, flow, userId, state string) error {
+	value, err := seal(oauthStateCookie, oauthState{
+		Flow:    flow,
+		State:   state,
+		UserId:  userId,
+		Expires: time.Now().Add(oauthStateLifetime).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	setCookie(w, r, oauthStateCookie, value, oauthStateLifetime)
+	return nil
+}
+
+// checkOAuthState verifies that state is what we sent when the flow
+// started in this browser, and that the same user is still signed in.
+// It returns the id of that user, and ends the flow.
+func checkOAuthState(w http.ResponseWriter, r *http.Request, flow, state string) (string, error) {
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return "", errOAuthState
+	}
+	setCookie(w, r, oauthStateCookie, "", -time.Second)
+
+	var st oauthState
+	if _, err := unseal(oauthStateCookie, cookie.Value, &st); err != nil {
+		return "", errOAuthState
+	}
+	if st.Flow != flow || state == "" ||
+		subtle.ConstantTimeCompare([]byte(st.State), []byte(state)) != 1 ||
+		time.Now().After(time.Unix(st.Expires, 0)) {
+		return "", errOAuthState
+	}
+	if st.UserId != "" {
+		s, _, err := getSession(r)
+		if err != nil || s.UserId != st.UserId {
+			return "", errOAuthState
+		}
+	}
+	return st.UserId, nil
+}
@@ -0,0 +1,109 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// The app runs either on App Engine (appengine.go) or as a standalone
+// server (standalone.go). This file has what both need to provide.
+
+var (
+	// ErrNoSuchEntity is returned by Storage when an entity is not found.
+	ErrNoSuchEntity = errors.New("storage: no such entity")
+	// ErrCacheMiss is returned by Cache when a key is not cached.
+	ErrCacheMiss = errors.New("cache: cache miss")
+)
+
+// Context is what a request needs from the platform: logging and a
+// way of making outbound HTTP requests.
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// Transport is the RoundTripper outbound requests go through.
+	Transport() http.RoundTripper
+}
+
+// httpClient returns a client for outbound requests.
+func httpClient(c Context) *http.Client {
+	return &http.Client{Transport: c.Transport()}
+}
+
+// Storage keeps entities that must survive restarts. Entities are
+// identified by their kind (e.g. "MastodonApp") and an id.
+type Storage interface {
+	Get(c Context, kind, id string, dst interface{}) error
+	Put(c Context, kind, id string, src interface{}) error
+	Delete(c Context, kind, id string) error
+}
+
+// UserStore keeps User records.
+type UserStore interface {
+	// Get returns ErrNoSuchEntity if there is no user with that id.
+	Get(c Context, id string) (*User, error)
+	Put(c Context, user *User) error
+	Delete(c Context, id string) error
+	// ListActive returns every user that has Active set.
+	ListActive(c Context) ([]*User, error)
+}
+
+// Cache keeps values that are fine to lose. Values expire after their
+// ttl, or may be evicted earlier.
+type Cache interface {
+	Get(c Context, key string) ([]byte, error)
+	Set(c Context, key string, value []byte, ttl time.Duration) error
+	// Add sets the value only if the key is not cached yet.
+	Add(c Context, key string, value []byte, ttl time.Duration) error
+	Delete(c Context, key string) error
+}
+
+// How long each kind of value is cached for.
+const (
+	// "user" + id: the User record, also updated on every save
+	userCacheTTL = time.Hour
+	// "memuser" + id: Google+ name and picture shown on the home page
+	memUserCacheTTL = 24 * time.Hour
+	// "pic" + id: Twitter profile picture URL
+	twitterPicCacheTTL = 24 * time.Hour
+	// the temporary token secret during Twitter sign in
+	twitterTempTokenCacheTTL = 15 * time.Minute
+	// "twitterConfig": Twitter asks clients to fetch it once a day
+	twitterConfigCacheTTL = 24 * time.Hour
+	// "picture" + url: downloaded media, only needed while publishing
+	// an activity to every destination
+	mediaCacheTTL = time.Hour
+)
+
+// storage, users and cache are set up by the platform.
+var (
+	storage Storage
+	users   UserStore
+	cache   Cache
+)
+
+func cacheGetJSON(c Context, key string, v interface{}) error {
+	b, err := cache.Get(c, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func cacheSetJSON(c Context, key string, v interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return cache.Set(c, key, b, ttl)
+}
@@ -0,0 +1,289 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A preview runs the publishers on the user's latest activities as if
+// they were being synced, but with a Context that records the requests
+// that would post anything instead of sending them.
+
+const (
+	defaultPreviewCount = 3
+	maxPreviewCount     = 10
+)
+
+// dryRunBody is what every recorded request gets back. It has what
+// each publisher reads from the responses to its posts and uploads,
+// with media already processed so nobody waits for it.
+const dryRunBody = `{
+	"id": "dry-run", "url": "dry-run",
+	"uri": "dry-run", "cid": "dry-run", "data": {"id": "dry-run"},
+	"blob": {"$type": "blob", "ref": {"$link": "dry-run"}, "mimeType": "image/jpeg", "size": 0}
+}`
+
+// dryRunTwitterBody is dryRunBody for twitter, whose ids are numbers.
+const dryRunTwitterBody = `{"id": 1, "id_str": "1", "media_id": 1, "media_id_string": "1"}`
+
+// form fields not shown in previews
+var secretFields = map[string]bool{
+	"access_token": true,
+	"password":     true,
+}
+
+// previewRequest is a request a publisher would have sent.
+type previewRequest struct {
+	Method string
+	URL    string
+	// Body is the body, made readable.
+	Body string
+}
+
+// dryRunContext is a Context whose requests that could change
+// anything, i.e. all but GET and HEAD, are recorded instead of sent.
+type dryRunContext struct {
+	Context
+	t *dryRunTransport
+}
+
+func (c dryRunContext) Transport() http.RoundTripper {
+	return c.t
+}
+
+type dryRunTransport struct {
+	rt       http.RoundTripper
+	requests []previewRequest
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return t.rt.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	u := *req.URL
+	u.RawQuery = formatForm(u.Query())
+	response := dryRunBody
+	if u.Host == "twitter.com" || strings.HasSuffix(u.Host, ".twitter.com") {
+		response = dryRunTwitterBody
+	}
+	t.requests = append(t.requests, previewRequest{
+		Method: req.Method,
+		URL:    u.String(),
+		Body:   formatBody(req.Header.Get("Content-Type"), body),
+	})
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(response)),
+		Request:    req,
+	}, nil
+}
+
+// formatForm encodes a form with its secrets hidden.
+func formatForm(form url.Values) string {
+	for k := range form {
+		if secretFields[k] {
+			form.Set(k, "hidden")
+		}
+	}
+	return form.Encode()
+}
+
+// formatBody makes a request body readable: forms are listed field by
+// field, JSON is indented and files are summarized.
+func formatBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			break
+		}
+		return formatFields(form)
+	case mediaType == "application/json":
+		var buf bytes.Buffer
+		if json.Indent(&buf, body, "", "  ") == nil {
+			return buf.String()
+		}
+	case strings.HasPrefix(mediaType, "multipart/"):
+		var buf bytes.Buffer
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return buf.String()
+			}
+			if err != nil {
+				break
+			}
+			data, _ := ioutil.ReadAll(part)
+			if part.FileName() != "" {
+				fmt.Fprintf(&buf, "%s: %s (%d bytes)\n", part.FormName(), part.FileName(), len(data))
+			} else if secretFields[part.FormName()] {
+				fmt.Fprintf(&buf, "%s: hidden\n", part.FormName())
+			} else {
+				fmt.Fprintf(&buf, "%s: %s\n", part.FormName(), data)
+			}
+		}
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return string(body)
+	}
+	return mediaType + " (" + strconv.Itoa(len(body)) + " bytes)"
+}
+
+func formatFields(form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		for _, v := range form[k] {
+			if secretFields[k] {
+				v = "hidden"
+			}
+			fmt.Fprintf(&buf, "%s: %s\n", k, v)
+		}
+	}
+	return buf.String()
+}
+
+// activityPreview is what would be sent for an activity.
+type activityPreview struct {
+	Source   string
+	Activity *Activity
+	// Link is the activity's URL if it is safe to link to.
+	Link    string
+	Results []publisherPreview
+}
+
+// safeLink returns s if it is an http or https URL, and "" otherwise,
+// as feeds can have any URL in their entries, javascript: too.
+func safeLink(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return s
+}
+
+type publisherPreview struct {
+	Publisher string
+	Requests  []previewRequest
+	Error     string
+}
+
+// previewActivity runs every publisher the user has enabled on act,
+// without posting anything. The publishers get a copy of the user, as
+// they may change it.
+func previewActivity(c Context, user *User, act *Activity) []publisherPreview {
+	var results []publisherPreview
+	post := newPost(act)
+	for _, p := range publishers {
+		u := *user
+		if !p.Enabled(&u) {
+			continue
+		}
+		t := &dryRunTransport{rt: c.Transport()}
+		_, err := p.Publish(dryRunContext{c, t}, &u, post)
+		res := publisherPreview{Publisher: p.Name(), Requests: t.requests}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// previewHandler shows what would be sent for the user's latest
+// activities from each source.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	user, err := loadUserCookie(r)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		n = defaultPreviewCount
+	}
+	if n > maxPreviewCount {
+		n = maxPreviewCount
+	}
+
+	before := user
+	var previews []activityPreview
+	for _, src := range sources {
+		if !src.Linked(&user) {
+			continue
+		}
+		acts, err := src.Fetch(c, &user)
+		if err != nil {
+			serveError(c, w, err)
+			return
+		}
+		sort.SliceStable(acts, func(i, j int) bool {
+			return acts[i].Published.After(acts[j].Published)
+		})
+		if len(acts) > n {
+			acts = acts[:n]
+		}
+		for _, act := range acts {
+			previews = append(previews, activityPreview{
+				Source:   src.Name(),
+				Activity: act,
+				Link:     safeLink(act.Url),
+				Results:  previewActivity(c, &user, act),
+			})
+		}
+	}
+	// fetching may have refreshed the tokens
+	if !reflect.DeepEqual(before, user) {
+		saveUser(c, &user)
+	}
+
+	sort.SliceStable(previews, func(i, j int) bool {
+		return previews[i].Activity.Published.After(previews[j].Activity.Published)
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "preview", map[string]interface{}{
+		"previews": previews,
+		"n":        n,
+	})
+}
@@ -0,0 +1,29 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import "testing"
+
+func TestSafeLink(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://plus.google.com/1/posts/a", "https://plus.google.com/1/posts/a"},
+		{"http://example.com/?a=1&b=2", "http://example.com/?a=1&b=2"},
+		{"HTTPS://example.com/", "HTTPS://example.com/"},
+		{"javascript:alert(1)", ""},
+		{"JavaScript:alert(1)", ""},
+		{"data:text/html,<script>alert(1)</script>", ""},
+		{"//example.com/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := safeLink(tt.url); got != tt.want {
+			t.Errorf("safeLink(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Publisher is a destination activities are sent to.
+type Publisher interface {
+	// Name identifies the publisher, e.g. "twitter".
+	Name() string
+
+	// Enabled reports whether the user is sharing to this publisher.
+	Enabled(user *User) bool
+
+	// Publish sends the post to the user's account and returns the
+	// id the destination gave it, if it tells us. It may modify the
+	// user (e.g. disable the publisher if access was revoked), in
+	// which case the caller must save it. Errors that trying again
+	// won't fix should be marked with permanent.
+	Publish(c Context, user *User, post *Post) (string, error)
+}
+
+var (
+	publishers       []Publisher
+	publishersByName = make(map[string]Publisher)
+)
+
+// registerPublisher makes a Publisher available to syncStream. It is
+// meant to be called from init functions.
+func registerPublisher(p Publisher) {
+	if _, dup := publishersByName[p.Name()]; dup {
+		panic("registerPublisher: duplicate publisher " + p.Name())
+	}
+	publishers = append(publishers, p)
+	publishersByName[p.Name()] = p
+}
+
+// permanentError is an error publishing that trying again won't fix,
+// such as a post the destination refuses.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// permanent marks err as permanent, so the post isn't retried.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// httpPermanent reports whether an HTTP status means the request will
+// fail however many times it is sent.
+func httpPermanent(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// Post is an Activity prepared for publishing.
+type Post struct {
+	Activity *Activity
+
+	// Kind is one of "status", "status_share" or the kind of
+	// the first attachment ("photo", "article", "video", ...).
+	Kind string
+
+	// Content is the text of the post, converted from HTML.
+	Content string
+
+	// Markdown is Content with its links in Markdown, for
+	// destinations that parse them.
+	Markdown string
+
+	// Attachment is the first attachment of the activity, if any.
+	Attachment *Attachment
+
+	// Photos are the attachments of the activity that are photos.
+	Photos []*Attachment
+}
+
+func newPost(act *Activity) *Post {
+	post := &Post{Activity: act}
+
+	content := act.Content
+	if act.Verb == "share" {
+		content = act.Annotation
+		post.Kind = "status_share"
+	} else {
+		post.Kind = "status"
+		if len(act.Attachments) > 0 {
+			post.Attachment = act.Attachments[0]
+			post.Kind = post.Attachment.Kind
+		}
+		for _, a := range act.Attachments {
+			if a.Kind == "photo" && a.Image != "" {
+				post.Photos = append(post.Photos, a)
+			}
+		}
+	}
+	post.Content = htmlToText(content, plainText)
+	post.Markdown = htmlToText(content, markdownLinks)
+	return post
+}
+
+// photos returns the first max photos of the post. more is set if
+// there were others, in which case publishers should link to the
+// activity so they can be seen there.
+func (post *Post) photos(max int) (photos []*Attachment, more bool) {
+	if len(post.Photos) > max {
+		return post.Photos[:max], true
+	}
+	return post.Photos, false
+}
+
+// largest file fetchMedia downloads
+const mediaMaxBytes = 32 << 20
+
+var errMediaTooLarge = errors.New("media: file too large")
+
+// fetchMedia downloads the file at url, going through the cache, or
+// reads it if it was kept from a Takeout archive.
+func fetchMedia(c Context, url string) ([]byte, error) {
+	if isTakeoutMedia(url) {
+		return loadTakeoutMedia(c, url)
+	}
+	media, err := cache.Get(c, "picture"+url)
+	if err == nil {
+		return media, nil
+	}
+
+	client := httpClient(c)
+	resp, err := client.Get(url)
+	c.Debugf("Downloading %s (%v)\n", url, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// maybe a passing error page, which mustn't be cached
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > mediaMaxBytes {
+		return nil, permanent(errMediaTooLarge)
+	}
+	media, err = ioutil.ReadAll(io.LimitReader(resp.Body, mediaMaxBytes+1))
+	c.Debugf("Reading contents of %s (%v)\n", url, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(media) > mediaMaxBytes {
+		return nil, permanent(errMediaTooLarge)
+	}
+	cache.Add(c, "picture"+url, media, mediaCacheTTL)
+	return media, nil
+}
+
+// fitText builds the text of a post out of content and link, truncating
+// content so the whole thing fits in max characters. urlLen is how
+// many characters the network counts for a link, or 0 if it counts the
+// link itself. Unless always is set, the link is only added when the
+// content had to be truncated.
+func fitText(content, link string, max, urlLen int, always bool) string {
+	n := utf8.RuneCountInString(content)
+	if link == "" || (!always && n <= max) {
+		if n > max {
+			return string([]rune(content)[:max-1]) + "…"
+		}
+		return content
+	}
+	if urlLen <= 0 {
+		urlLen = utf8.RuneCountInString(link)
+	}
+	// leave room for the link and a space
+	l := max - urlLen - 1
+	if l < 1 {
+		return link
+	}
+	if n > l {
+		content = string([]rune(content)[:l-1]) + "…"
+	}
+	if content == "" {
+		return link
+	}
+	return content + " " + link
+}
@@ -0,0 +1,211 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+var errInvalidSession = errors.New("session: invalid or expired")
+
+var errCSRF = errors.New("This page has expired, please reload it and try again")
+
+// session is what we keep in the session cookie. The cookie is
+// encrypted and authenticated with AES-GCM, so users can neither read
+// nor forge it.
+type session struct {
+	UserId  string
+	Expires int64 // Unix time
+	// CSRF is sent back by forms, proving they come from our pages.
+	CSRF string
+}
+
+// sessionKeys returns the keys sessions are sealed with. The first is
+// the current SessionStoreKey; the others are previous keys, which are
+// still accepted so that changing the key doesn't log everyone out.
+func sessionKeys() [][]byte {
+	keys := make([][]byte, 0, 1+len(appConfig.OldSessionStoreKeys))
+	for _, k := range append([]string{appConfig.SessionStoreKey}, appConfig.OldSessionStoreKeys...) {
+		sum := sha256.Sum256([]byte("session:" + k))
+		keys = append(keys, sum[:])
+	}
+	return keys
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates v with the current key. purpose
+// is bound to the result, so that a value sealed for one use can't be
+// passed off as another.
+func seal(purpose string, v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(sessionKeys()[0])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(purpose))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// unseal reverses seal, trying every key. old is set if the value was
+// sealed with an old key.
+func unseal(purpose, value string, v interface{}) (old bool, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return false, errInvalidSession
+	}
+	for i, key := range sessionKeys() {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return false, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return false, errInvalidSession
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, ciphertext, []byte(purpose))
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(plain, v); err != nil {
+			return false, errInvalidSession
+		}
+		return i > 0, nil
+	}
+	return false, errInvalidSession
+}
+
+// setSession starts a new session for the user.
+func setSession(w http.ResponseWriter, r *http.Request, userId string) error {
+	_, err := renewSession(w, r, &session{UserId: userId})
+	return err
+}
+
+// renewSession extends the session s, keeping its CSRF token so that
+// forms already shown still work, or giving it one if it has none. It
+// returns the token.
+func renewSession(w http.ResponseWriter, r *http.Request, s *session) (string, error) {
+	if s.CSRF == "" {
+		b := make([]byte, 24)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		s.CSRF = base64.RawURLEncoding.EncodeToString(b)
+	}
+	s.Expires = time.Now().Add(sessionLifetime).Unix()
+	value, err := seal(sessionCookie, s)
+	if err != nil {
+		return "", err
+	}
+	setCookie(w, r, sessionCookie, value, sessionLifetime)
+	return s.CSRF, nil
+}
+
+// setCookie sets one of our cookies, for maxAge or, if it is negative,
+// deleting it. They are kept from scripts and from requests started by
+// other sites, and only sent over https if r came that way.
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge time.Duration) {
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   appConfig.AppDomain,
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getSession returns the session in the request. rotate is set if the
+// session was sealed with an old key or is halfway to expiring, in
+// which case the caller should start a new one with setSession.
+func getSession(r *http.Request) (s *session, rotate bool, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false, err
+	}
+	s = new(session)
+	old, err := unseal(sessionCookie, cookie.Value, s)
+	if err != nil {
+		return nil, false, err
+	}
+	expires := time.Unix(s.Expires, 0)
+	if s.UserId == "" || time.Now().After(expires) {
+		return nil, false, errInvalidSession
+	}
+	return s, old || time.Until(expires) < sessionLifetime/2, nil
+}
+
+// sessionUserId returns the id of the signed in user, or "".
+func sessionUserId(r *http.Request) string {
+	s, _, err := getSession(r)
+	if err != nil {
+		return ""
+	}
+	return s.UserId
+}
+
+// csrfToken returns the CSRF token of the session, for the forms in
+// a page, renewing the session if it needs it. Sessions from before
+// CSRF tokens get one here. It returns "" if there is no session.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	s, rotate, err := getSession(r)
+	if err != nil {
+		return ""
+	}
+	token := s.CSRF
+	if rotate || token == "" {
+		token, _ = renewSession(w, r, s)
+	}
+	return token
+}
+
+// checkCSRF reports whether the form in r carries the CSRF token of
+// the session. Handlers that change anything on a POST must check it.
+func checkCSRF(r *http.Request) bool {
+	s, _, err := getSession(r)
+	if err != nil || s.CSRF == "" {
+		return false
+	}
+	token := r.FormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
+
+// clearSession logs the user out.
+func clearSession(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, sessionCookie, "", -time.Second)
+}
@@ -0,0 +1,188 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSessionKeys makes key the SessionStoreKey, and old the keys it
+// replaced, for the rest of the test.
+func testSessionKeys(t *testing.T, key string, old ...string) {
+	saved, savedOld := appConfig.SessionStoreKey, appConfig.OldSessionStoreKeys
+	t.Cleanup(func() {
+		appConfig.SessionStoreKey, appConfig.OldSessionStoreKeys = saved, savedOld
+	})
+	appConfig.SessionStoreKey, appConfig.OldSessionStoreKeys = key, old
+}
+
+// testSessionRequest returns a request carrying s in its cookie.
+func testSessionRequest(t *testing.T, s session) *http.Request {
+	value, err := seal(sessionCookie, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+	return r
+}
+
+func TestSealUnseal(t *testing.T) {
+	testSessionKeys(t, "key")
+	in := session{UserId: "1", Expires: 1234, CSRF: "token"}
+	value, err := seal(sessionCookie, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(value, "token") {
+		t.Errorf("sealed value %q shows its contents", value)
+	}
+	var out session
+	if old, err := unseal(sessionCookie, value, &out); err != nil || old || out != in {
+		t.Errorf("unseal = %+v, old=%v, %v, want %+v", out, old, err, in)
+	}
+	// every value is sealed differently
+	if again, _ := seal(sessionCookie, in); again == value {
+		t.Errorf("seal gave the same value twice")
+	}
+	// sealed for something else
+	if _, err := unseal(oauthStateCookie, value, &out); err != errInvalidSession {
+		t.Errorf("unseal for another purpose = %v, want %v", err, errInvalidSession)
+	}
+}
+
+func TestUnsealInvalid(t *testing.T) {
+	testSessionKeys(t, "key")
+	value, err := seal(sessionCookie, session{UserId: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.RawURLEncoding.DecodeString(value)
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 1
+	nonce := append([]byte(nil), raw...)
+	nonce[0] ^= 1
+
+	for name, v := range map[string]string{
+		"tampered":             base64.RawURLEncoding.EncodeToString(tampered),
+		"tampered nonce":       base64.RawURLEncoding.EncodeToString(nonce),
+		"truncated":            base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1]),
+		"shorter than a nonce": base64.RawURLEncoding.EncodeToString(raw[:4]),
+		"empty":                "",
+		"not base64":           value[:10] + "!" + value[11:],
+	} {
+		var s session
+		if _, err := unseal(sessionCookie, v, &s); err != errInvalidSession {
+			t.Errorf("%s: unseal = %v, want %v", name, err, errInvalidSession)
+		}
+	}
+
+	// sealed with a key we no longer know
+	testSessionKeys(t, "other", "older")
+	var s session
+	if _, err := unseal(sessionCookie, value, &s); err != errInvalidSession {
+		t.Errorf("unknown key: unseal = %v, want %v", err, errInvalidSession)
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	testSessionKeys(t, "key")
+	now := time.Now()
+	tests := []struct {
+		name   string
+		s      session
+		ok     bool
+		rotate bool
+	}{
+		{"fresh", session{UserId: "1", Expires: now.Add(sessionLifetime).Unix()}, true, false},
+		{"halfway", session{UserId: "1", Expires: now.Add(sessionLifetime/2 - time.Hour).Unix()}, true, true},
+		{"expired", session{UserId: "1", Expires: now.Add(-time.Second).Unix()}, false, false},
+		{"no user", session{Expires: now.Add(sessionLifetime).Unix()}, false, false},
+	}
+	for _, tt := range tests {
+		s, rotate, err := getSession(testSessionRequest(t, tt.s))
+		if (err == nil) != tt.ok || rotate != tt.rotate {
+			t.Errorf("%s: getSession = rotate=%v, %v, want ok=%v, rotate=%v", tt.name, rotate, err, tt.ok, tt.rotate)
+			continue
+		}
+		if tt.ok && s.UserId != tt.s.UserId {
+			t.Errorf("%s: getSession = user %q, want %q", tt.name, s.UserId, tt.s.UserId)
+		}
+	}
+	if _, _, err := getSession(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("getSession without a cookie succeeded")
+	}
+}
+
+func TestSessionOldKey(t *testing.T) {
+	testSessionKeys(t, "old")
+	r := testSessionRequest(t, session{UserId: "1", Expires: time.Now().Add(sessionLifetime).Unix(), CSRF: "token"})
+
+	// the key was changed since
+	testSessionKeys(t, "new", "old")
+	s, rotate, err := getSession(r)
+	if err != nil || !rotate {
+		t.Fatalf("getSession = rotate=%v, %v, want the session, to be rotated", rotate, err)
+	}
+
+	w := httptest.NewRecorder()
+	token, err := renewSession(w, r, s)
+	if err != nil || token != "token" {
+		t.Fatalf("renewSession = %q, %v, want the same token", token, err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("renewSession set %v, want the session cookie", cookies)
+	}
+	var renewed session
+	old, err := unseal(sessionCookie, cookies[0].Value, &renewed)
+	if err != nil || old {
+		t.Errorf("renewed session: old=%v, %v, want it sealed with the new key", old, err)
+	}
+	if renewed.UserId != "1" || renewed.CSRF != "token" {
+		t.Errorf("renewed session = %+v", renewed)
+	}
+
+	// once the old key is dropped, only the renewed one works
+	testSessionKeys(t, "new")
+	if _, _, err := getSession(r); err == nil {
+		t.Errorf("session sealed with a dropped key still accepted")
+	}
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.AddCookie(cookies[0])
+	if _, rotate, err := getSession(r2); err != nil || rotate {
+		t.Errorf("renewed session: rotate=%v, %v", rotate, err)
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	testSessionKeys(t, "key")
+	s := session{UserId: "1", Expires: time.Now().Add(sessionLifetime).Unix(), CSRF: "token"}
+	for _, tt := range []struct {
+		token string
+		s     session
+		want  bool
+	}{
+		{"token", s, true},
+		{"wrong", s, false},
+		{"", s, false},
+		{"", session{UserId: "1", Expires: s.Expires}, false},
+	} {
+		r := testSessionRequest(t, tt.s)
+		r.Method = "POST"
+		r.Form = url.Values{"csrf": {tt.token}}
+		if got := checkCSRF(r); got != tt.want {
+			t.Errorf("checkCSRF(%q) with session token %q = %v, want %v", tt.token, tt.s.CSRF, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"time"
+)
+
+// Activity is a post read from a Source, normalized so that
+// publishers don't need to know where it came from.
+type Activity struct {
+	Id    string
+	Verb  string // "post" or "share"
+	Title string
+
+	// Content is the body of the post, as HTML.
+	Content string
+	// Annotation is the text added by the user when resharing.
+	Annotation string
+	// ActorName is the name of the original author of a reshared post.
+	ActorName string
+
+	// Url is the permalink of the activity itself, ObjectUrl the
+	// permalink of the object it refers to.
+	Url       string
+	ObjectUrl string
+
+	Published   time.Time
+	Attachments []*Attachment
+}
+
+// Attachment is a piece of media attached to an Activity.
+type Attachment struct {
+	Kind        string // "photo", "article", "video", "album", ...
+	Url         string
+	DisplayName string
+	Image       string // URL of the full size image, if any
+	Video       string // URL of the video file, if any
+}
+
+// Source is somewhere we read activities from.
+type Source interface {
+	// Name identifies the source, e.g. "google".
+	Name() string
+
+	// Linked reports whether the user has connected this source.
+	Linked(user *User) bool
+
+	// Latest and SetLatest read and update the high-water mark
+	// (UnixNano of the newest activity already synced) kept on the
+	// user for this source.
+	Latest(user *User) int64
+	SetLatest(user *User, latest int64)
+
+	// Seen and SetSeen read and update the ids of the latest
+	// activities synced, oldest first.
+	Seen(user *User) []string
+	SetSeen(user *User, ids []string)
+
+	// Fetch returns the most recent activities for the user, going
+	// back to the newest one already synced if it can, but no further
+	// than appConfig.SyncMaxActivities. It may update the user's
+	// credentials, which the caller must then save.
+	Fetch(c Context, user *User) ([]*Activity, error)
+}
+
+var sources []Source
+
+const defaultSyncMaxActivities = 100
+
+// How many activity ids are remembered per source. Activities older
+// than those are told apart by the high-water mark.
+const seenWindow = 200
+
+// syncSkew is how much older than the high-water mark an activity not
+// seen before may be and still be synced, as sources don't always list
+// activities in the order they were published and clocks disagree.
+const syncSkew = 10 * time.Minute
+
+// unseen returns the activities in acts that haven't been synced yet,
+// and records them as seen.
+func unseen(c Context, src Source, user *User, acts []*Activity) []*Activity {
+	since := src.Latest(user)
+	ids := src.Seen(user)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	cutoff := since
+	if len(ids) > 0 {
+		cutoff -= int64(syncSkew)
+	} // else only the high-water mark was kept so far
+
+	latest := since
+	var fresh []*Activity
+	for _, act := range acts {
+		nPub := act.Published.UnixNano()
+
+		c.Debugf("unseen: user: %s, source: %s, id: %s, nPub: %v, Latest: %v\n", user.Id, src.Name(), act.Id, nPub, since)
+
+		if seen[act.Id] {
+			continue
+		}
+		seen[act.Id] = true
+		ids = append(ids, act.Id)
+		if nPub > cutoff {
+			fresh = append(fresh, act)
+		}
+		if nPub > latest {
+			latest = nPub
+		}
+	}
+	if len(ids) > seenWindow {
+		ids = ids[len(ids)-seenWindow:]
+	}
+	src.SetLatest(user, latest)
+	src.SetSeen(user, ids)
+	return fresh
+}
+
+// forget undoes unseen for the activities with ids, so that they are
+// synced again: they are no longer seen, and the high-water mark goes
+// back to latest, what it was before. The activities that were synced
+// are still told apart by their ids.
+func forget(src Source, user *User, latest int64, ids []string) {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	var seen []string
+	for _, id := range src.Seen(user) {
+		if !drop[id] {
+			seen = append(seen, id)
+		}
+	}
+	src.SetLatest(user, latest)
+	src.SetSeen(user, seen)
+}
+
+// registerSource makes a Source available to syncStream. It is meant
+// to be called from init functions.
+func registerSource(s Source) {
+	sources = append(sources, s)
+}
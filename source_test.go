@@ -0,0 +1,170 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testContext logs to the test.
+type testContext struct {
+	t *testing.T
+}
+
+func (c testContext) Debugf(format string, args ...interface{})   { c.t.Logf(format, args...) }
+func (c testContext) Infof(format string, args ...interface{})    { c.t.Logf(format, args...) }
+func (c testContext) Warningf(format string, args ...interface{}) { c.t.Logf(format, args...) }
+func (c testContext) Errorf(format string, args ...interface{})   { c.t.Logf(format, args...) }
+func (c testContext) Transport() http.RoundTripper                { return http.DefaultTransport }
+
+// testSource keeps its high-water mark and seen ids itself.
+type testSource struct {
+	latest int64
+	seen   []string
+}
+
+func (s *testSource) Name() string                                     { return "test" }
+func (s *testSource) Linked(user *User) bool                           { return true }
+func (s *testSource) Latest(user *User) int64                          { return s.latest }
+func (s *testSource) SetLatest(user *User, latest int64)               { s.latest = latest }
+func (s *testSource) Seen(user *User) []string                         { return s.seen }
+func (s *testSource) SetSeen(user *User, ids []string)                 { s.seen = ids }
+func (s *testSource) Fetch(c Context, user *User) ([]*Activity, error) { return nil, nil }
+
+func TestUnseen(t *testing.T) {
+	base := time.Date(2011, 7, 1, 12, 0, 0, 0, time.UTC)
+	at := func(id string, d time.Duration) *Activity {
+		return &Activity{Id: id, Published: base.Add(d)}
+	}
+	tests := []struct {
+		name   string
+		latest time.Duration
+		seen   []string
+		acts   []*Activity
+		want   []string
+		// the high-water mark and ids kept after
+		latestAfter time.Duration
+		seenAfter   []string
+	}{
+		{
+			name:   "new",
+			latest: 0,
+			seen:   []string{"a"},
+			acts:   []*Activity{at("a", 0), at("b", time.Minute), at("c", 2*time.Minute)},
+			want:   []string{"b", "c"},
+
+			latestAfter: 2 * time.Minute,
+			seenAfter:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "late within skew",
+			latest: 0,
+			seen:   []string{"a"},
+			acts:   []*Activity{at("b", -5*time.Minute)},
+			want:   []string{"b"},
+
+			latestAfter: 0,
+			seenAfter:   []string{"a", "b"},
+		},
+		{
+			name:   "too old",
+			latest: 0,
+			seen:   []string{"a"},
+			acts:   []*Activity{at("b", -syncSkew-time.Second)},
+			want:   nil,
+
+			latestAfter: 0,
+			seenAfter:   []string{"a", "b"},
+		},
+		{
+			// only the mark was kept, as before ids were
+			name:   "no ids",
+			latest: 0,
+			acts:   []*Activity{at("a", -time.Minute), at("b", 0), at("c", time.Minute)},
+			want:   []string{"c"},
+
+			latestAfter: time.Minute,
+			seenAfter:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "repeated",
+			latest: 0,
+			seen:   []string{"a"},
+			acts:   []*Activity{at("b", time.Minute), at("b", time.Minute), at("a", 0)},
+			want:   []string{"b"},
+
+			latestAfter: time.Minute,
+			seenAfter:   []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		src := &testSource{latest: base.Add(tt.latest).UnixNano(), seen: tt.seen}
+		var got []string
+		for _, act := range unseen(testContext{t}, src, &User{}, tt.acts) {
+			got = append(got, act.Id)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: unseen = %v, want %v", tt.name, got, tt.want)
+		}
+		if want := base.Add(tt.latestAfter).UnixNano(); src.latest != want {
+			t.Errorf("%s: latest = %v, want %v", tt.name, time.Unix(0, src.latest).UTC(), time.Unix(0, want).UTC())
+		}
+		if !reflect.DeepEqual(src.seen, tt.seenAfter) {
+			t.Errorf("%s: seen = %v, want %v", tt.name, src.seen, tt.seenAfter)
+		}
+	}
+}
+
+func TestUnseenWindow(t *testing.T) {
+	base := time.Date(2011, 7, 1, 12, 0, 0, 0, time.UTC)
+	src := &testSource{latest: base.UnixNano(), seen: []string{"old"}}
+	var acts []*Activity
+	for i := 0; i < seenWindow+10; i++ {
+		acts = append(acts, &Activity{Id: fmt.Sprint(i), Published: base.Add(time.Duration(i+1) * time.Minute)})
+	}
+	if got := unseen(testContext{t}, src, &User{}, acts); len(got) != len(acts) {
+		t.Errorf("unseen returned %d activities, want %d", len(got), len(acts))
+	}
+	if len(src.seen) != seenWindow {
+		t.Fatalf("%d ids kept, want %d", len(src.seen), seenWindow)
+	}
+	if first, last := src.seen[0], src.seen[len(src.seen)-1]; first != "10" || last != fmt.Sprint(seenWindow+9) {
+		t.Errorf("kept ids %s to %s, want the newest", first, last)
+	}
+
+	// the oldest ids were forgotten, but they are far older than the
+	// mark, which still stops them
+	if got := unseen(testContext{t}, src, &User{}, acts[:10]); len(got) != 0 {
+		t.Errorf("unseen returned %d forgotten activities, want 0", len(got))
+	}
+}
+
+func TestForget(t *testing.T) {
+	base := time.Date(2011, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, seen := range [][]string{nil, {"old"}} {
+		src := &testSource{latest: base.UnixNano(), seen: seen}
+		acts := []*Activity{
+			{Id: "a", Published: base.Add(time.Minute)},
+			{Id: "b", Published: base.Add(2 * time.Minute)},
+		}
+		latest := src.Latest(nil)
+		unseen(testContext{t}, src, &User{}, acts)
+		forget(src, &User{}, latest, []string{"b"})
+
+		var got []string
+		for _, act := range unseen(testContext{t}, src, &User{}, acts) {
+			got = append(got, act.Id)
+		}
+		if !reflect.DeepEqual(got, []string{"b"}) {
+			t.Errorf("seen %v: after forgetting b, unseen = %v, want [b]", seen, got)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+package gplus2others
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations bring the database schema up to date. The schema version
+// is kept in SQLite's user_version, which is the number of migrations
+// applied so far. Only ever append to this list.
+var migrations = []string{
+	// 1: users are stored as JSON, with the columns we query on
+	// kept alongside
+	`CREATE TABLE users (
+		id     TEXT PRIMARY KEY,
+		active INTEGER NOT NULL DEFAULT 0,
+		data   TEXT NOT NULL
+	);
+	CREATE INDEX users_active ON users (active);`,
+
+	// 2: everything else
+	`CREATE TABLE entities (
+		kind TEXT NOT NULL,
+		id   TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (kind, id)
+	);`,
+
+	// 3: the delivery ledger
+	`CREATE TABLE deliveries (
+		id          TEXT PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		publisher   TEXT NOT NULL,
+		source      TEXT NOT NULL,
+		activity_id TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		remote_id   TEXT NOT NULL DEFAULT '',
+		error       TEXT NOT NULL DEFAULT '',
+		attempts    INTEGER NOT NULL DEFAULT 0,
+		created     INTEGER NOT NULL,
+		updated     INTEGER NOT NULL
+	);
+	CREATE INDEX deliveries_user ON deliveries (user_id, updated);`,
+
+	// 4: retrying failed deliveries
+	`ALTER TABLE deliveries ADD COLUMN next_attempt INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE deliveries ADD COLUMN activity BLOB;
+	CREATE INDEX deliveries_due ON deliveries (user_id, status, next_attempt);`,
+}
+
+// openSQLite opens the database at path, creating it if needed, and
+// applies any pending migrations.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time anyway
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for version < len(migrations) {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite: migration %d: %v", version+1, err)
+		}
+		// PRAGMA doesn't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version++
+	}
+	return nil
+}
+
+// sqliteUserStore keeps users in SQLite.
+type sqliteUserStore struct {
+	db *sql.DB
+}
+
+func (s sqliteUserStore) Get(c Context, id string) (*User, error) {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM users WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, err
+	}
+	user := new(User)
+	if err := json.Unmarshal([]byte(data), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s sqliteUserStore) Put(c Context, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO users (id, active, data) VALUES (?, ?, ?)`,
+		user.Id, user.Active, string(data))
+	return err
+}
+
+func (s sqliteUserStore) Delete(c Context, id string) error {
+	_, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+func (s sqliteUserStore) ListActive(c Context) ([]*User, error) {
+	rows, err := s.db.Query("SELECT data FROM users WHERE active = 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var active []*User
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		user := new(User)
+		if err := json.Unmarshal([]byte(data), user); err != nil {
+			return nil, err
+		}
+		active = append(active, user)
+	}
+	return active, rows.Err()
+}
+
+// sqliteStorage keeps other entities in SQLite, as JSON.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func (s sqliteStorage) Get(c Context, kind, id string, dst interface{}) error {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM entities WHERE kind = ? AND id = ?", kind, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNoSuchEntity
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), dst)
+}
+
+func (s sqliteStorage) Put(c Context, kind, id string, src interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO entities (kind, id, data) VALUES (?, ?, ?)",
+		kind, id, string(data))
+	return err
+}
+
+func (s sqliteStorage) Delete(c Context, kind, id string) error {
+	_, err := s.db.Exec("DELETE FROM entities WHERE kind = ? AND id = ?", kind, id)
+	return err
+}
+
+// sqliteDeliveryStore keeps the delivery ledger in SQLite.
+type sqliteDeliveryStore struct {
+	db *sql.DB
+}
+
+const deliveryColumns = "user_id, publisher, source, activity_id, status, remote_id, error, attempts, next_attempt, activity, created, updated"
+
+func scanDelivery(row interface {
+	Scan(dest ...interface{}) error
+}) (*Delivery, error) {
+	d := new(Delivery)
+	var next, created, updated int64
+	err := row.Scan(&d.UserId, &d.Publisher, &d.Source, &d.ActivityId, &d.Status,
+		&d.RemoteId, &d.Error, &d.Attempts, &next, &d.Activity, &created, &updated)
+	if err != nil {
+		return nil, err
+	}
+	d.NextAttempt = time.Unix(0, next)
+	d.Created, d.Updated = time.Unix(0, created), time.Unix(0, updated)
+	return d, nil
+}
+
+func (s sqliteDeliveryStore) Get(c Context, id string) (*Delivery, error) {
+	d, err := scanDelivery(s.db.QueryRow("SELECT "+deliveryColumns+" FROM deliveries WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchEntity
+	}
+	return d, err
+}
+
+func (s sqliteDeliveryStore) Put(c Context, d *Delivery) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO deliveries (id, "+deliveryColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.Id(), d.UserId, d.Publisher, d.Source, d.ActivityId, d.Status,
+		d.RemoteId, d.Error, d.Attempts, d.NextAttempt.UnixNano(), d.Activity,
+		d.Created.UnixNano(), d.Updated.UnixNano())
+	return err
+}
+
+func (s sqliteDeliveryStore) Claim(c Context, d *Delivery, status string) (bool, error) {
+	var res sql.Result
+	var err error
+	if status == "" {
+		res, err = s.db.Exec("INSERT OR IGNORE INTO deliveries (id, "+deliveryColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			d.Id(), d.UserId, d.Publisher, d.Source, d.ActivityId, d.Status,
+			d.RemoteId, d.Error, d.Attempts, d.NextAttempt.UnixNano(), d.Activity,
+			d.Created.UnixNano(), d.Updated.UnixNano())
+	} else {
+		res, err = s.db.Exec("UPDATE deliveries SET status = ?, attempts = ?, next_attempt = ?, updated = ? WHERE id = ? AND status = ? AND attempts = ?",
+			d.Status, d.Attempts, d.NextAttempt.UnixNano(), d.Updated.UnixNano(), d.Id(), status, d.Attempts-1)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s sqliteDeliveryStore) List(c Context, userId string, limit int) ([]*Delivery, error) {
+	rows, err := s.db.Query("SELECT "+deliveryColumns+" FROM deliveries WHERE user_id = ? ORDER BY updated DESC LIMIT ?",
+		userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func scanDeliveries(rows *sql.Rows) ([]*Delivery, error) {
+	defer rows.Close()
+
+	var list []*Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+func (s sqliteDeliveryStore) Due(c Context, userId, status string, now time.Time, limit int) ([]*Delivery, error) {
+	rows, err := s.db.Query("SELECT "+deliveryColumns+" FROM deliveries WHERE user_id = ? AND status = ? AND next_attempt <= ? ORDER BY next_attempt LIMIT ?",
+		userId, status, now.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s sqliteDeliveryStore) DeleteUser(c Context, userId string) error {
+	_, err := s.db.Exec("DELETE FROM deliveries WHERE user_id = ?", userId)
+	return err
+}
@@ -0,0 +1,91 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+package gplus2others
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func testUserVersion(t *testing.T, db *sql.DB) int {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v := testUserVersion(t, db); v != len(migrations) {
+		t.Fatalf("user_version = %d, want %d", v, len(migrations))
+	}
+	// the last migration's column is there
+	if _, err := db.Exec("UPDATE deliveries SET next_attempt = 0, activity = NULL"); err != nil {
+		t.Errorf("deliveries isn't up to date: %v", err)
+	}
+
+	// migrating again changes nothing
+	if _, err := db.Exec("INSERT INTO users (id, active, data) VALUES ('1', 1, '{}')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	if v := testUserVersion(t, db); v != len(migrations) {
+		t.Errorf("user_version = %d after migrating again, want %d", v, len(migrations))
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil || n != 1 {
+		t.Errorf("%d users after migrating again (%v), want 1", n, err)
+	}
+}
+
+func TestMigrateReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unico.db")
+
+	// a database from before the ledger
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations[:2] {
+		if _, err := db.Exec(m); err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+	}
+	if _, err := db.Exec("PRAGMA user_version = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO entities (kind, id, data) VALUES ('MastodonApp', 'mastodon.social', '{}')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		db, err := openSQLite(path)
+		if err != nil {
+			t.Fatalf("open %d: %v", i+1, err)
+		}
+		if v := testUserVersion(t, db); v != len(migrations) {
+			t.Errorf("open %d: user_version = %d, want %d", i+1, v, len(migrations))
+		}
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM entities").Scan(&n); err != nil || n != 1 {
+			t.Errorf("open %d: %d entities (%v), want 1", i+1, n, err)
+		}
+		db.Close()
+	}
+}
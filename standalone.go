@@ -0,0 +1,132 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+package gplus2others
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ServerConfig configures the standalone server.
+type ServerConfig struct {
+	// Addr is the address to listen on, e.g. ":8080".
+	Addr string
+	// DataDir is where the SQLite database is kept.
+	DataDir string
+	// SyncInterval is how often activities are synced, replacing
+	// the App Engine cron job.
+	SyncInterval time.Duration
+	// CacheSize is the most memory, in bytes, cached values may
+	// take. Zero means defaultCacheSize.
+	CacheSize int64
+	// Debug enables debug logging.
+	Debug bool
+	// SyncKey, if set, lets requests to /sync with it in the
+	// X-Sync-Key header trigger a sync. Without it /sync is closed.
+	SyncKey string
+}
+
+const defaultCacheSize = 64 << 20
+
+var (
+	debug   bool
+	syncKey string
+)
+
+// ListenAndServe runs the app as a standalone server.
+func ListenAndServe(conf ServerConfig) error {
+	if conf.SyncInterval <= 0 {
+		return errors.New("unico: invalid sync interval")
+	}
+	debug = conf.Debug
+	syncKey = conf.SyncKey
+
+	if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+		return err
+	}
+	db, err := openSQLite(filepath.Join(conf.DataDir, "unico.db"))
+	if err != nil {
+		return err
+	}
+	storage = sqliteStorage{db}
+	users = sqliteUserStore{db}
+	deliveries = sqliteDeliveryStore{db}
+	cacheSize := conf.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
+	}
+	cache = newLRUCache(cacheSize)
+
+	// on App Engine these are served by app.yaml
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/robots.txt")
+	})
+	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/favicon.ico")
+	})
+
+	go schedule(conf.SyncInterval)
+
+	log.Printf("unico: listening on %s", conf.Addr)
+	return http.ListenAndServe(conf.Addr, nil)
+}
+
+// schedule runs syncAll every interval.
+func schedule(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		c := newContext(nil)
+		if _, err := syncAll(c); err != nil {
+			c.Errorf("schedule: sync failed: %v\n", err)
+		}
+	}
+}
+
+type localContext struct{}
+
+func (localContext) Debugf(format string, args ...interface{}) {
+	if debug {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
+
+func (localContext) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (localContext) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
+
+func (localContext) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+func (localContext) Transport() http.RoundTripper {
+	return http.DefaultTransport
+}
+
+func newContext(r *http.Request) Context {
+	return localContext{}
+}
+
+// syncAllowed reports whether r may trigger a sync. The scheduler
+// syncs on its own, so /sync is only open to requests with the sync
+// key. Behind a proxy every request looks local, so the address
+// isn't trusted.
+func syncAllowed(r *http.Request) bool {
+	key := r.Header.Get("X-Sync-Key")
+	return syncKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(syncKey)) == 1
+}
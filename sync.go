@@ -0,0 +1,195 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for appConfig.SyncWorkers and SyncUserTimeout.
+const (
+	defaultSyncWorkers     = 4
+	defaultSyncUserTimeout = time.Minute
+)
+
+var errSyncDeadline = errors.New("sync: out of time for this user")
+
+// syncStats counts what happened to the users in a sync.
+type syncStats struct {
+	Users   int // active users
+	Synced  int
+	Skipped int // tokens can't be read, or nothing to read from
+	Failed  int // a source couldn't be read, or out of time
+	Elapsed time.Duration
+}
+
+func (s syncStats) String() string {
+	return fmt.Sprintf("%d users: %d synced, %d skipped, %d failed in %v",
+		s.Users, s.Synced, s.Skipped, s.Failed, s.Elapsed)
+}
+
+type syncResult int
+
+const (
+	syncSynced syncResult = iota
+	syncSkipped
+	syncFailed
+)
+
+// syncAll syncs every active user, SyncWorkers users at a time, so
+// that a slow user doesn't hold up everyone after them.
+func syncAll(c Context) (syncStats, error) {
+	start := time.Now()
+	active, err := users.ListActive(c)
+	if err != nil {
+		return syncStats{}, err
+	}
+
+	workers := appConfig.SyncWorkers
+	if workers <= 0 {
+		workers = defaultSyncWorkers
+	}
+	timeout := time.Duration(appConfig.SyncUserTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSyncUserTimeout
+	}
+
+	stats := syncStats{Users: len(active)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan *User)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range queue {
+				r := syncUser(c, user, time.Now().Add(timeout))
+				mu.Lock()
+				switch r {
+				case syncSynced:
+					stats.Synced++
+				case syncSkipped:
+					stats.Skipped++
+				default:
+					stats.Failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, user := range active {
+		queue <- user
+	}
+	close(queue)
+	wg.Wait()
+
+	stats.Elapsed = time.Since(start)
+	c.Infof("syncAll: %v\n", stats)
+	return stats, nil
+}
+
+// syncUser syncs one user. Requests made for the user fail once
+// deadline has passed.
+func syncUser(c Context, user *User, deadline time.Time) (r syncResult) {
+	defer func() {
+		// one user's bad data mustn't stop everyone else's sync
+		if err := recover(); err != nil {
+			c.Errorf("syncUser: panic syncing %s: %v\n", user.Id, err)
+			r = syncFailed
+		}
+	}()
+
+	resave, err := openUser(user)
+	if err != nil {
+		c.Errorf("syncUser: can't decrypt tokens of %s. Err: %v\n", user.Id, err)
+		return syncSkipped
+	}
+	linked := false
+	for _, src := range sources {
+		linked = linked || src.Linked(user)
+	}
+	if !linked {
+		return syncSkipped
+	}
+
+	dc := deadlineContext{c, deadline}
+	if resave {
+		saveUser(dc, user)
+	}
+	err = syncStream(dc, user)
+	if err == nil && time.Now().After(deadline) {
+		err = errSyncDeadline
+	}
+	if err != nil {
+		c.Warningf("syncUser: %s: %v\n", user.Id, err)
+		return syncFailed
+	}
+	return syncSynced
+}
+
+// syncDeadline returns the time by which the work done with c must be
+// over, if there is one.
+func syncDeadline(c Context) (time.Time, bool) {
+	for {
+		switch cc := c.(type) {
+		case deadlineContext:
+			return cc.deadline, true
+		case dryRunContext:
+			c = cc.Context
+		default:
+			return time.Time{}, false
+		}
+	}
+}
+
+// deadlineContext is a Context whose outbound requests are cut off at
+// deadline.
+type deadlineContext struct {
+	Context
+	deadline time.Time
+}
+
+func (c deadlineContext) Transport() http.RoundTripper {
+	return deadlineTransport{c.Context.Transport(), c.deadline}
+}
+
+type deadlineTransport struct {
+	rt       http.RoundTripper
+	deadline time.Time
+}
+
+func (t deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !time.Now().Before(t.deadline) {
+		return nil, errSyncDeadline
+	}
+	ctx, cancel := context.WithDeadline(req.Context(), t.deadline)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the body is read after RoundTrip returns
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
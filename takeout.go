@@ -0,0 +1,613 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google+ posts can be imported from a Google Takeout export, in JSON,
+// and sent to the user's destinations. Imported posts are queued in
+// the delivery ledger and sent a few at a time by the sync.
+
+// takeoutSource is the Delivery.Source of imported posts.
+const takeoutSource = "takeout"
+
+const (
+	// most of an upload kept in memory, the rest goes to disk
+	takeoutMaxMemory = 8 << 20
+	// largest upload accepted
+	takeoutMaxUpload = 512 << 20
+	// largest post file read
+	takeoutMaxPost = 1 << 20
+	// largest photo or video kept from an archive; larger ones are
+	// left to their URL
+	takeoutMaxMedia = 16 << 20
+	// default for appConfig.ImportInterval
+	defaultImportInterval = 5 * time.Minute
+)
+
+var (
+	errTakeoutEmpty     = errors.New("No public Google+ posts in that range were found in the files")
+	errTakeoutPost      = errors.New("A file in the export is too large to be a post")
+	errTakeoutSince     = errors.New("Enter when you started sending your posts")
+	errTakeoutMediaSize = errors.New("takeout: media file too large")
+)
+
+// takeoutPost is a post in the "Google+ Stream/Posts" folder of a
+// Takeout export.
+type takeoutPost struct {
+	Url          string `json:"url"`
+	ResourceName string `json:"resourceName"`
+	CreationTime string `json:"creationTime"`
+	Content      string `json:"content"`
+
+	Link  *takeoutLink  `json:"link"`
+	Media *takeoutMedia `json:"media"`
+	Album *struct {
+		Media []*takeoutMedia `json:"media"`
+	} `json:"album"`
+
+	ResharedPost *struct {
+		Url    string `json:"url"`
+		Author struct {
+			DisplayName string `json:"displayName"`
+		} `json:"author"`
+		Content string        `json:"content"`
+		Link    *takeoutLink  `json:"link"`
+		Media   *takeoutMedia `json:"media"`
+	} `json:"resharedPost"`
+
+	PostAcl struct {
+		VisibleToStandardAcl struct {
+			Circles []struct {
+				Type string `json:"type"`
+			} `json:"circles"`
+		} `json:"visibleToStandardAcl"`
+	} `json:"postAcl"`
+}
+
+type takeoutLink struct {
+	Title    string `json:"title"`
+	Url      string `json:"url"`
+	ImageUrl string `json:"imageUrl"`
+}
+
+type takeoutMedia struct {
+	Url         string `json:"url"`
+	ContentType string `json:"contentType"`
+	Description string `json:"description"`
+	// the file in the archive, next to the post
+	LocalFilePath string `json:"localFilePath"`
+}
+
+// takeoutTimeLayout is how Takeout writes times, e.g.
+// "2017-03-01 12:34:56+0000".
+const takeoutTimeLayout = "2006-01-02 15:04:05-0700"
+
+func (p *takeoutPost) public() bool {
+	for _, circle := range p.PostAcl.VisibleToStandardAcl.Circles {
+		if circle.Type == "CIRCLE_TYPE_PUBLIC" {
+			return true
+		}
+	}
+	return false
+}
+
+// media returns the post's photos and videos, including those of a
+// reshared post.
+func (p *takeoutPost) media() []*takeoutMedia {
+	var media []*takeoutMedia
+	if p.Media != nil {
+		media = append(media, p.Media)
+	}
+	if p.Album != nil {
+		media = append(media, p.Album.Media...)
+	}
+	if s := p.ResharedPost; s != nil && s.Media != nil {
+		media = append(media, s.Media)
+	}
+	return media
+}
+
+// id is the Activity.Id of the post.
+func (p *takeoutPost) id() string {
+	if p.ResourceName != "" {
+		return p.ResourceName
+	}
+	return p.Url
+}
+
+// activity converts the post to an Activity, as googleSource would
+// have read it.
+func (p *takeoutPost) activity() (*Activity, error) {
+	published, err := time.Parse(takeoutTimeLayout, p.CreationTime)
+	if err != nil {
+		return nil, err
+	}
+	act := &Activity{
+		Id:        p.id(),
+		Verb:      "post",
+		Content:   p.Content,
+		Url:       p.Url,
+		ObjectUrl: p.Url,
+		Published: published,
+	}
+	link, media := p.Link, []*takeoutMedia{p.Media}
+	if p.Album != nil {
+		media = append(media, p.Album.Media...)
+	}
+	if s := p.ResharedPost; s != nil {
+		act.Verb = "share"
+		act.Annotation = p.Content
+		act.Content = s.Content
+		act.ActorName = s.Author.DisplayName
+		act.ObjectUrl = s.Url
+		link, media = s.Link, []*takeoutMedia{s.Media}
+	}
+
+	for _, m := range media {
+		if m == nil || m.Url == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(m.ContentType, "image/"):
+			act.Attachments = append(act.Attachments, &Attachment{
+				Kind:        "photo",
+				Url:         act.Url,
+				DisplayName: m.Description,
+				Image:       m.Url,
+			})
+		case strings.HasPrefix(m.ContentType, "video/"):
+			act.Attachments = append(act.Attachments, &Attachment{
+				Kind:        "video",
+				Url:         act.Url,
+				DisplayName: m.Description,
+				Video:       m.Url,
+			})
+		}
+	}
+	if link != nil && link.Url != "" {
+		act.Attachments = append(act.Attachments, &Attachment{
+			Kind:        "article",
+			Url:         link.Url,
+			DisplayName: link.Title,
+			Image:       link.ImageUrl,
+		})
+	}
+	return act, nil
+}
+
+// readTakeout reads the public posts published between from and to in
+// a Takeout export, either a zip archive or one of the JSON files in
+// it. The photos and videos of the posts in an archive are kept for
+// the user, as their URLs no longer work, unless the post was already
+// queued for all of dests.
+func readTakeout(c Context, user *User, dests []Publisher, r io.ReaderAt, size int64, name string, from, to time.Time) ([]*Activity, error) {
+	if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+		p, err := readTakeoutPost(c, io.NewSectionReader(r, 0, size), name, from, to)
+		if p == nil {
+			return nil, err
+		}
+		return takeoutActivity(c, p, name)
+	}
+
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	var acts []*Activity
+	for _, f := range z.File {
+		// other products in the export have JSON files too
+		if path.Base(path.Dir(f.Name)) != "Posts" || path.Ext(f.Name) != ".json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		p, err := readTakeoutPost(c, rc, f.Name, from, to)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			continue
+		}
+		if queued, err := takeoutQueued(c, user, dests, p.id()); queued || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, m := range p.media() {
+			mf := files[path.Join(path.Dir(f.Name), m.LocalFilePath)]
+			if m.LocalFilePath == "" || mf == nil {
+				continue
+			}
+			url, err := saveTakeoutMedia(c, user, mf)
+			if err != nil {
+				c.Debugf("readTakeout(%s): can't keep %s. Err: %v\n", f.Name, mf.Name, err)
+				if err == errTakeoutMediaSize {
+					continue
+				}
+				return nil, err
+			}
+			m.Url = url
+		}
+		a, err := takeoutActivity(c, p, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		acts = append(acts, a...)
+	}
+	return acts, nil
+}
+
+// readTakeoutPost reads a post, returning nil if it isn't one, isn't
+// public or wasn't published between from and to.
+func readTakeoutPost(c Context, r io.Reader, name string, from, to time.Time) (*takeoutPost, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, takeoutMaxPost+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > takeoutMaxPost {
+		return nil, errTakeoutPost
+	}
+	var p takeoutPost
+	if err := json.Unmarshal(data, &p); err != nil {
+		c.Debugf("readTakeout(%s): err=%v\n", name, err)
+		return nil, nil
+	}
+	if !p.public() {
+		return nil, nil
+	}
+	published, err := time.Parse(takeoutTimeLayout, p.CreationTime)
+	if err != nil {
+		c.Debugf("readTakeout(%s): err=%v\n", name, err)
+		return nil, nil
+	}
+	if published.Before(from) || !published.Before(to) {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func takeoutActivity(c Context, p *takeoutPost, name string) ([]*Activity, error) {
+	act, err := p.activity()
+	if err != nil {
+		c.Debugf("readTakeout(%s): err=%v\n", name, err)
+		return nil, nil
+	}
+	return []*Activity{act}, nil
+}
+
+// Photos and videos from an archive are kept in storage, split in
+// chunks that fit in an entity, until the user is deleted. They are
+// found by the URLs saveTakeoutMedia returns, which fetchMedia reads.
+const (
+	takeoutMediaKind      = "TakeoutMedia"
+	takeoutMediaScheme    = "takeout:"
+	takeoutMediaChunkSize = 900 << 10
+	// the ids of a user's media
+	takeoutMediaListKind = "TakeoutMediaList"
+)
+
+type takeoutMediaChunk struct {
+	Data []byte `datastore:",noindex"`
+	// how many chunks there are, in the first one
+	Chunks int `datastore:",noindex"`
+}
+
+type takeoutMediaList struct {
+	Ids []string `datastore:",noindex"`
+}
+
+// saveTakeoutMedia keeps the media file f for the user and returns
+// its URL.
+func saveTakeoutMedia(c Context, user *User, f *zip.File) (string, error) {
+	if f.UncompressedSize64 > takeoutMaxMedia {
+		return "", errTakeoutMediaSize
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rc, takeoutMaxMedia+1))
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(data) > takeoutMaxMedia {
+		return "", errTakeoutMediaSize
+	}
+
+	// the same file is often in several posts
+	h := sha1.Sum(data)
+	id := user.Id + "/" + hex.EncodeToString(h[:])
+	var list takeoutMediaList
+	if err := storage.Get(c, takeoutMediaListKind, user.Id, &list); err != nil && err != ErrNoSuchEntity {
+		return "", err
+	}
+	known := false
+	for _, i := range list.Ids {
+		if i == id {
+			known = true
+			break
+		}
+	}
+	if !known {
+		// listed first, so that it is deleted with the user even
+		// if storing it fails halfway
+		list.Ids = append(list.Ids, id)
+		if err := storage.Put(c, takeoutMediaListKind, user.Id, &list); err != nil {
+			return "", err
+		}
+	}
+
+	chunks := (len(data) + takeoutMediaChunkSize - 1) / takeoutMediaChunkSize
+	for i := 0; i < chunks; i++ {
+		chunk := takeoutMediaChunk{Data: data[i*takeoutMediaChunkSize:]}
+		if len(chunk.Data) > takeoutMediaChunkSize {
+			chunk.Data = chunk.Data[:takeoutMediaChunkSize]
+		}
+		if i == 0 {
+			chunk.Chunks = chunks
+		}
+		if err := storage.Put(c, takeoutMediaKind, id+"/"+strconv.Itoa(i), &chunk); err != nil {
+			return "", err
+		}
+	}
+	return takeoutMediaScheme + id, nil
+}
+
+// isTakeoutMedia reports whether url is one of saveTakeoutMedia's.
+func isTakeoutMedia(url string) bool {
+	return strings.HasPrefix(url, takeoutMediaScheme)
+}
+
+// loadTakeoutMedia returns the media file saved as url.
+func loadTakeoutMedia(c Context, url string) ([]byte, error) {
+	id := strings.TrimPrefix(url, takeoutMediaScheme)
+	var data []byte
+	for i, chunks := 0, 1; i < chunks; i++ {
+		var chunk takeoutMediaChunk
+		if err := storage.Get(c, takeoutMediaKind, id+"/"+strconv.Itoa(i), &chunk); err != nil {
+			if err == ErrNoSuchEntity {
+				// deleted, or never fully stored
+				return nil, permanent(fmt.Errorf("takeout: no media %s", id))
+			}
+			return nil, err
+		}
+		if i == 0 {
+			chunks = chunk.Chunks
+		}
+		data = append(data, chunk.Data...)
+	}
+	return data, nil
+}
+
+// deleteTakeoutMedia deletes the media files kept for the user.
+func deleteTakeoutMedia(c Context, userId string) error {
+	var list takeoutMediaList
+	if err := storage.Get(c, takeoutMediaListKind, userId, &list); err != nil {
+		if err == ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	for _, id := range list.Ids {
+		var first takeoutMediaChunk
+		err := storage.Get(c, takeoutMediaKind, id+"/0", &first)
+		if err == ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i := first.Chunks - 1; i >= 0; i-- {
+			if err := storage.Delete(c, takeoutMediaKind, id+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return storage.Delete(c, takeoutMediaListKind, userId)
+}
+
+// takeoutQueued reports whether the activity id was already queued for
+// all of dests, and so would be skipped by queueImport.
+func takeoutQueued(c Context, user *User, dests []Publisher, id string) (bool, error) {
+	for _, p := range dests {
+		_, err := deliveries.Get(c, deliveryId(user.Id, p.Name(), takeoutSource, id))
+		if err == ErrNoSuchEntity {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// queueImport queues acts to be sent to dests, one activity every
+// ImportInterval so as not to flood the user's followers. Activities
+// already sent or queued are skipped. It returns how many were queued.
+func queueImport(c Context, user *User, dests []Publisher, acts []*Activity) (int, error) {
+	interval := time.Duration(appConfig.ImportInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultImportInterval
+	}
+
+	now := time.Now()
+	at := now
+	n := 0
+	for _, act := range acts {
+		data, err := json.Marshal(act)
+		if err != nil {
+			return n, err
+		}
+		queued := false
+		for _, p := range dests {
+			d := &Delivery{
+				UserId:      user.Id,
+				Publisher:   p.Name(),
+				Source:      takeoutSource,
+				ActivityId:  act.Id,
+				Status:      deliveryQueued,
+				NextAttempt: at,
+				Activity:    data,
+				Created:     now,
+				Updated:     now,
+			}
+			// unless already sent or queued
+			ok, err := deliveries.Claim(c, d, "")
+			if err != nil {
+				return n, err
+			}
+			if !ok {
+				continue
+			}
+			queued = true
+		}
+		if queued {
+			n++
+			at = at.Add(interval)
+		}
+	}
+	return n, nil
+}
+
+// takeoutHandler shows the import form and imports the files posted
+// to it.
+func takeoutHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	user, err := loadUserCookie(r)
+	if err != nil || user.Id == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	var enabled []string
+	for _, p := range publishers {
+		if p.Enabled(&user) {
+			enabled = append(enabled, p.Name())
+		}
+	}
+	// the sync sent the posts after the user signed up; users from
+	// before that was kept tell us when it was
+	since := time.Unix(0, user.GoogleSince)
+	if r.Method != "POST" {
+		params := map[string]interface{}{
+			"dests": enabled,
+			"csrf":  csrfToken(w, r),
+		}
+		if user.GoogleSince != 0 {
+			params["since"] = since.Format("January 2, 2006")
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		templates.ExecuteTemplate(w, "takeout", params)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, takeoutMaxUpload)
+	if err := r.ParseMultipartForm(takeoutMaxMemory); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	if !checkCSRF(r) {
+		serveError(c, w, errCSRF)
+		return
+	}
+	if user.GoogleSince == 0 {
+		since, err = time.Parse("2006-01-02", r.FormValue("since"))
+		if err != nil || since.After(time.Now()) {
+			serveError(c, w, errTakeoutSince)
+			return
+		}
+	}
+	from, err := time.Parse("2006-01-02", r.FormValue("from"))
+	if err != nil {
+		serveError(c, w, errors.New("Invalid start date"))
+		return
+	}
+	to, err := time.Parse("2006-01-02", r.FormValue("to"))
+	if err != nil {
+		serveError(c, w, errors.New("Invalid end date"))
+		return
+	}
+	// the whole last day
+	to = to.AddDate(0, 0, 1)
+	if to.After(since) {
+		to = since
+	}
+
+	var dests []Publisher
+	for _, name := range r.Form["dest"] {
+		if p := publishersByName[name]; p != nil && p.Enabled(&user) {
+			dests = append(dests, p)
+		}
+	}
+	if len(dests) == 0 {
+		serveError(c, w, errors.New("Choose where to send the posts"))
+		return
+	}
+
+	var acts []*Activity
+	for _, fh := range r.MultipartForm.File["archive"] {
+		f, err := fh.Open()
+		if err != nil {
+			serveError(c, w, err)
+			return
+		}
+		a, err := readTakeout(c, &user, dests, f, fh.Size, fh.Filename, from, to)
+		f.Close()
+		if err != nil {
+			serveError(c, w, err)
+			return
+		}
+		acts = append(acts, a...)
+	}
+	if len(acts) == 0 {
+		serveError(c, w, errTakeoutEmpty)
+		return
+	}
+	sort.SliceStable(acts, func(i, j int) bool {
+		return acts[i].Published.Before(acts[j].Published)
+	})
+
+	n, err := queueImport(c, &user, dests, acts)
+	c.Infof("takeoutHandler: queued %d of %d posts for %s (%v)\n", n, len(acts), user.Id, err)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	if user.GoogleSince == 0 {
+		// only asked once
+		user.GoogleSince = since.UnixNano()
+		if err := saveUser(c, &user); err != nil {
+			c.Debugf("takeoutHandler(%s): couldn't save the start date. Err: %v\n", user.Id, err)
+		}
+	}
+	http.Redirect(w, r, "/history", http.StatusFound)
+}
@@ -0,0 +1,41 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTakeoutPost(t *testing.T) {
+	post := func(created, circle string) string {
+		return `{"url": "https://plus.google.com/1/posts/a", "creationTime": "` + created +
+			`", "content": "hi", "postAcl": {"visibleToStandardAcl": {"circles": [{"type": "` + circle + `"}]}}}`
+	}
+	from := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+		err  error
+	}{
+		{"public", post("2017-03-01 12:34:56+0000", "CIRCLE_TYPE_PUBLIC"), true, nil},
+		{"private", post("2017-03-01 12:34:56+0000", "CIRCLE_TYPE_YOUR_CIRCLES"), false, nil},
+		{"before", post("2016-12-31 23:59:59+0000", "CIRCLE_TYPE_PUBLIC"), false, nil},
+		{"at the end", post("2018-01-01 00:00:00+0000", "CIRCLE_TYPE_PUBLIC"), false, nil},
+		{"not a post", "<html>", false, nil},
+		{"too large", `{"content": "` + strings.Repeat("x", takeoutMaxPost) + `"}`, false, errTakeoutPost},
+	}
+	for _, tt := range tests {
+		p, err := readTakeoutPost(testContext{t}, strings.NewReader(tt.data), tt.name, from, to)
+		if (p != nil) != tt.ok || err != tt.err {
+			t.Errorf("%s: readTakeoutPost = %v, %v, want ok=%v, %v", tt.name, p != nil, err, tt.ok, tt.err)
+		}
+	}
+}
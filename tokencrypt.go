@@ -0,0 +1,198 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// OAuth tokens are stored encrypted, using envelope encryption: each
+// user's tokens are encrypted with a random data key, and the data key
+// is encrypted with TokenEncryptionKey from the configuration and kept
+// in User.TokenDataKey, prefixed by the id of the key that encrypted it.
+//
+// To rotate TokenEncryptionKey, move the old key to
+// OldTokenEncryptionKeys. Users are re-encrypted with the new key as
+// they are loaded.
+
+// encryptedTokenPrefix marks a field as encrypted. Fields without it
+// predate encryption and are encrypted the next time the user is saved.
+const encryptedTokenPrefix = "enc1:"
+
+var errTokenKey = errors.New("tokens: data key encrypted with an unknown key")
+
+type tokenKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// tokenKeys returns the configured keys, the current one first.
+func tokenKeys() ([]tokenKey, error) {
+	var keys []tokenKey
+	for _, k := range append([]string{appConfig.TokenEncryptionKey}, appConfig.OldTokenEncryptionKeys...) {
+		sum := sha256.Sum256([]byte("tokens:" + k))
+		aead, err := newAEAD(sum[:])
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(sum[:])
+		keys = append(keys, tokenKey{id: hex.EncodeToString(id[:4]), aead: aead})
+	}
+	return keys, nil
+}
+
+func aeadSeal(aead cipher.AEAD, plain, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, data), nil
+}
+
+func aeadOpen(aead cipher.AEAD, sealed, data []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("tokens: ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], data)
+}
+
+// userTokens lists the fields of user that are encrypted.
+func userTokens(user *User) []struct {
+	name  string
+	value *string
+} {
+	return []struct {
+		name  string
+		value *string
+	}{
+		{"GoogleAccessToken", &user.GoogleAccessToken},
+		{"GoogleRefreshToken", &user.GoogleRefreshToken},
+		{"TwitterOAuthToken", &user.TwitterOAuthToken},
+		{"TwitterOAuthSecret", &user.TwitterOAuthSecret},
+		{"ADNAccessToken", &user.ADNAccessToken},
+		{"MastodonAccessToken", &user.MastodonAccessToken},
+		{"BlueskyAccessJwt", &user.BlueskyAccessJwt},
+		{"BlueskyRefreshJwt", &user.BlueskyRefreshJwt},
+		{"FBAccessToken", &user.FBAccessToken},
+	}
+}
+
+// userDataKey returns the user's data key, creating one if needed.
+// rewrapped is set if TokenDataKey changed because the user had no
+// data key or it was encrypted with an old key.
+func userDataKey(user *User) (key []byte, rewrapped bool, err error) {
+	keys, err := tokenKeys()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if user.TokenDataKey == "" {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, false, err
+		}
+	} else {
+		i := strings.Index(user.TokenDataKey, ":")
+		if i < 0 {
+			return nil, false, errTokenKey
+		}
+		id := user.TokenDataKey[:i]
+		wrapped, err := base64.StdEncoding.DecodeString(user.TokenDataKey[i+1:])
+		if err != nil {
+			return nil, false, err
+		}
+		for n, k := range keys {
+			if k.id != id {
+				continue
+			}
+			key, err = aeadOpen(k.aead, wrapped, []byte(user.Id))
+			if err != nil {
+				return nil, false, err
+			}
+			if n == 0 {
+				return key, false, nil
+			}
+			break
+		}
+		if key == nil {
+			return nil, false, errTokenKey
+		}
+	}
+
+	wrapped, err := aeadSeal(keys[0].aead, key, []byte(user.Id))
+	if err != nil {
+		return nil, false, err
+	}
+	user.TokenDataKey = keys[0].id + ":" + base64.StdEncoding.EncodeToString(wrapped)
+	return key, true, nil
+}
+
+// sealUser returns a copy of user with its tokens encrypted, ready to
+// be stored. It also sets user.TokenDataKey, so the same data key is
+// used the next time.
+func sealUser(user *User) (User, error) {
+	key, _, err := userDataKey(user)
+	if err != nil {
+		return User{}, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return User{}, err
+	}
+
+	sealed := *user
+	for _, t := range userTokens(&sealed) {
+		if *t.value == "" {
+			continue
+		}
+		b, err := aeadSeal(aead, []byte(*t.value), []byte(t.name+":"+user.Id))
+		if err != nil {
+			return User{}, err
+		}
+		*t.value = encryptedTokenPrefix + base64.StdEncoding.EncodeToString(b)
+	}
+	return sealed, nil
+}
+
+// openUser decrypts the tokens of a stored user in place. It reports
+// whether the user should be saved again, because its data key was
+// encrypted with an old key or it had tokens stored in plain text.
+func openUser(user *User) (resave bool, err error) {
+	key, rewrapped, err := userDataKey(user)
+	if err != nil {
+		return false, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return false, err
+	}
+
+	resave = rewrapped
+	for _, t := range userTokens(user) {
+		if !strings.HasPrefix(*t.value, encryptedTokenPrefix) {
+			resave = resave || *t.value != ""
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*t.value, encryptedTokenPrefix))
+		if err != nil {
+			return false, err
+		}
+		plain, err := aeadOpen(aead, b, []byte(t.name+":"+user.Id))
+		if err != nil {
+			return false, err
+		}
+		*t.value = string(plain)
+	}
+	return resave, nil
+}
@@ -0,0 +1,173 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"strings"
+	"testing"
+)
+
+// testTokenKeys makes key the TokenEncryptionKey, and old the keys it
+// replaced, for the rest of the test.
+func testTokenKeys(t *testing.T, key string, old ...string) {
+	saved, savedOld := appConfig.TokenEncryptionKey, appConfig.OldTokenEncryptionKeys
+	t.Cleanup(func() {
+		appConfig.TokenEncryptionKey, appConfig.OldTokenEncryptionKeys = saved, savedOld
+	})
+	appConfig.TokenEncryptionKey, appConfig.OldTokenEncryptionKeys = key, old
+}
+
+func testTokenUser() *User {
+	return &User{
+		Id:                 "1",
+		GoogleAccessToken:  "google-access",
+		GoogleRefreshToken: "google-refresh",
+		TwitterOAuthSecret: "twitter-secret",
+		BlueskyRefreshJwt:  "bluesky-refresh",
+		TwitterScreenName:  "me",
+	}
+}
+
+func TestSealUserRoundTrip(t *testing.T) {
+	testTokenKeys(t, "key")
+	user := testTokenUser()
+	sealed, err := sealUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.GoogleAccessToken != "google-access" {
+		t.Errorf("sealUser changed the user's tokens")
+	}
+	if user.TokenDataKey == "" || sealed.TokenDataKey != user.TokenDataKey {
+		t.Errorf("TokenDataKey = %q, sealed %q, want them set and equal", user.TokenDataKey, sealed.TokenDataKey)
+	}
+	for _, tok := range userTokens(&sealed) {
+		if *tok.value == "" {
+			continue
+		}
+		if !strings.HasPrefix(*tok.value, encryptedTokenPrefix) || strings.Contains(*tok.value, "-") {
+			t.Errorf("%s = %q, want it encrypted", tok.name, *tok.value)
+		}
+	}
+	if sealed.ADNAccessToken != "" || sealed.TwitterScreenName != "me" {
+		t.Errorf("sealUser changed what isn't a token: %+v", sealed)
+	}
+
+	opened := sealed
+	resave, err := openUser(&opened)
+	if err != nil || resave {
+		t.Fatalf("openUser = resave=%v, %v", resave, err)
+	}
+	if want := testTokenUser(); opened.GoogleAccessToken != want.GoogleAccessToken ||
+		opened.GoogleRefreshToken != want.GoogleRefreshToken ||
+		opened.TwitterOAuthSecret != want.TwitterOAuthSecret ||
+		opened.BlueskyRefreshJwt != want.BlueskyRefreshJwt {
+		t.Errorf("openUser = %+v, want the tokens of %+v", opened, want)
+	}
+
+	// sealing again keeps the data key
+	key := user.TokenDataKey
+	if _, err := sealUser(user); err != nil || user.TokenDataKey != key {
+		t.Errorf("sealing again changed TokenDataKey (%v)", err)
+	}
+}
+
+func TestOpenUserOldKey(t *testing.T) {
+	testTokenKeys(t, "old")
+	sealed, err := sealUser(testTokenUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := sealed.TokenDataKey
+
+	testTokenKeys(t, "new", "old")
+	opened := sealed
+	resave, err := openUser(&opened)
+	if err != nil || !resave {
+		t.Fatalf("openUser = resave=%v, %v, want it to be saved again", resave, err)
+	}
+	if opened.GoogleRefreshToken != "google-refresh" {
+		t.Errorf("GoogleRefreshToken = %q", opened.GoogleRefreshToken)
+	}
+	if opened.TokenDataKey == oldKey || strings.Split(opened.TokenDataKey, ":")[0] == strings.Split(oldKey, ":")[0] {
+		t.Errorf("TokenDataKey %q still wrapped with the old key", opened.TokenDataKey)
+	}
+
+	// saved again, it doesn't need the old key anymore
+	resealed, err := sealUser(&opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTokenKeys(t, "new")
+	if resave, err := openUser(&resealed); err != nil || resave || resealed.GoogleRefreshToken != "google-refresh" {
+		t.Errorf("openUser after rewrapping = resave=%v, %v, %q", resave, err, resealed.GoogleRefreshToken)
+	}
+}
+
+func TestOpenUserPlaintext(t *testing.T) {
+	testTokenKeys(t, "key")
+	// stored before tokens were encrypted
+	user := testTokenUser()
+	resave, err := openUser(user)
+	if err != nil || !resave {
+		t.Fatalf("openUser = resave=%v, %v, want it to be saved again", resave, err)
+	}
+	if user.GoogleAccessToken != "google-access" || user.TokenDataKey == "" {
+		t.Errorf("openUser = %+v, want the tokens as they were, and a data key", user)
+	}
+
+	sealed, err := sealUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resave, err := openUser(&sealed); err != nil || resave || sealed.GoogleAccessToken != "google-access" {
+		t.Errorf("openUser once migrated = resave=%v, %v, %q", resave, err, sealed.GoogleAccessToken)
+	}
+
+	// a user without tokens has nothing to migrate but its data key
+	empty := &User{Id: "2"}
+	if resave, err := openUser(empty); err != nil || !resave {
+		t.Errorf("openUser without tokens = resave=%v, %v", resave, err)
+	}
+}
+
+func TestOpenUserErrors(t *testing.T) {
+	testTokenKeys(t, "key")
+	sealed, err := sealUser(testTokenUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(u *User)
+		err    error // nil for any error
+	}{
+		{"unknown key", func(u *User) { testTokenKeys(t, "other", "older") }, errTokenKey},
+		{"no key id", func(u *User) { u.TokenDataKey = strings.SplitN(u.TokenDataKey, ":", 2)[1] }, errTokenKey},
+		{"corrupt data key", func(u *User) { u.TokenDataKey = u.TokenDataKey[:len(u.TokenDataKey)-4] + "AAA=" }, nil},
+		{"corrupt token", func(u *User) {
+			b := []byte(u.GoogleAccessToken)
+			b[len(b)-3] ^= 1
+			u.GoogleAccessToken = string(b)
+		}, nil},
+		{"truncated token", func(u *User) { u.GoogleAccessToken = encryptedTokenPrefix + "AAAA" }, nil},
+		{"not base64", func(u *User) { u.GoogleAccessToken += "!" }, nil},
+		// encrypted tokens can't be moved around
+		{"other field", func(u *User) { u.GoogleAccessToken = u.GoogleRefreshToken }, nil},
+		{"other user", func(u *User) { u.Id = "2" }, nil},
+	}
+	for _, tt := range tests {
+		testTokenKeys(t, "key")
+		u := sealed
+		tt.change(&u)
+		_, err := openUser(&u)
+		if err == nil || (tt.err != nil && err != tt.err) {
+			t.Errorf("%s: openUser = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
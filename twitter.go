@@ -9,17 +9,12 @@ package gplus2others
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"path"
 	"strings"
+	"unicode"
 
-	"google.golang.org/api/plus/v1"
+	"golang.org/x/text/unicode/norm"
 	"gopkg.in/tweetlib.v2"
-
-	"appengine"
-	"appengine/memcache"
-	"appengine/urlfetch"
 )
 
 var _ = fmt.Println
@@ -30,8 +25,10 @@ func twitterHandler(w http.ResponseWriter, r *http.Request) {
 		signInTwitterHandler(w, r)
 	case "temp":
 		twitterVerify(w, r)
+	case "thread":
+		twitterThreadHandler(w, r)
 	default:
-		c := appengine.NewContext(r)
+		c := newContext(r)
 		serveError(c, w, errors.New("Invalid Action Parameter"))
 		return
 	}
@@ -39,17 +36,21 @@ func twitterHandler(w http.ResponseWriter, r *http.Request) {
 
 func twitterVerify(w http.ResponseWriter, r *http.Request) {
 	token := r.FormValue("oauth_token")
-	id := r.FormValue("id")
-	c := appengine.NewContext(r)
+	c := newContext(r)
 
-	if id == "" {
-		serveError(c, w, errors.New("Missing ID parameter"))
+	// the temporary token is our state: it must be the one we got
+	// when this user started signing in
+	id, err := checkOAuthState(w, r, "twitter", token)
+	if err != nil {
+		serveError(c, w, err)
 		return
 	}
 
-	item, _ := memcache.Get(c, token)
-
-	secret := string(item.Value)
+	secret, err := cache.Get(c, token)
+	if err != nil {
+		serveError(c, w, errors.New("Twitter sign in expired, please try again"))
+		return
+	}
 	verifier := r.FormValue("oauth_verifier")
 
 	conf := &tweetlib.Config{
@@ -58,12 +59,12 @@ func twitterVerify(w http.ResponseWriter, r *http.Request) {
 	tok := &tweetlib.Token{}
 	tr := &tweetlib.Transport{Config: conf,
 		Token:     tok,
-		Transport: &urlfetch.Transport{Context: c}}
+		Transport: c.Transport()}
 
-	tt := &tweetlib.TempToken{Token: token, Secret: secret}
-	tok, err := tr.AccessToken(tt, verifier)
+	tt := &tweetlib.TempToken{Token: token, Secret: string(secret)}
+	tok, err = tr.AccessToken(tt, verifier)
 	if err != nil {
-		c := appengine.NewContext(r)
+		c := newContext(r)
 		serveError(c, w, err)
 		c.Errorf("%v", err)
 		return
@@ -71,13 +72,23 @@ func twitterVerify(w http.ResponseWriter, r *http.Request) {
 	tr.Token = tok
 	tl, _ := tweetlib.New(tr.Client())
 	u, err := tl.Account.VerifyCredentials(nil)
-	fmt.Printf("err=%v\n", err)
-	user := loadUser(r, id)
+	if err != nil {
+		serveError(c, w, err)
+		return
+	}
+	user, err := loadUser(c, id)
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			err = errors.New("Invalid user ID")
+		}
+		serveError(c, w, err)
+		return
+	}
 	user.TwitterOAuthToken = tok.OAuthToken
 	user.TwitterOAuthSecret = tok.OAuthSecret
 	user.TwitterId = u.IdStr
 	user.TwitterScreenName = u.ScreenName
-	if err := saveUser(r, &user); err != nil {
+	if err := saveUser(c, &user); err != nil {
 		serveError(c, w, err)
 		return
 	}
@@ -88,86 +99,98 @@ func twitterVerify(w http.ResponseWriter, r *http.Request) {
 
 func signInTwitterHandler(w http.ResponseWriter, r *http.Request) {
 
-	c := appengine.NewContext(r)
-	id := r.FormValue("id")
+	c := newContext(r)
+	id := sessionUserId(r)
 	if id == "" {
-		serveError(c, w, errors.New("Missing ID parameter"))
+		serveError(c, w, errors.New("Not signed in"))
 		return
 	}
 
 	conf := &tweetlib.Config{
 		ConsumerKey:    appConfig.TwitterConsumerKey,
 		ConsumerSecret: appConfig.TwitterConsumerSecret,
-		Callback:       "http://" + appConfig.AppHost + "/twitter?action=temp&id=" + id}
+		Callback:       "http://" + appConfig.AppHost + "/twitter?action=temp"}
 	tok := &tweetlib.Token{}
 	tr := &tweetlib.Transport{Config: conf,
 		Token:     tok,
-		Transport: &urlfetch.Transport{Context: c}}
+		Transport: c.Transport()}
 
 	tt, err := tr.TempToken()
 	if err != nil {
-		c := appengine.NewContext(r)
+		c := newContext(r)
 		serveError(c, w, err)
 		c.Errorf("%v", err)
 		return
 	}
-	item := &memcache.Item{
-		Key:   tt.Token,
-		Value: []byte(tt.Secret),
+	// Add the secret to the cache, if the key does not already exist
+	cache.Add(c, tt.Token, []byte(tt.Secret), twitterTempTokenCacheTTL)
+	if err := setOAuthState(w, r, "twitter", id, tt.Token); err != nil {
+		serveError(c, w, err)
+		return
 	}
-	// Add the item to the memcache, if the key does not already exist
-	memcache.Add(c, item)
 
 	http.Redirect(w, r, tt.AuthURL(), http.StatusFound)
 }
 
-func publishActivityToTwitter(w http.ResponseWriter, r *http.Request, act *plus.Activity, user *User) {
-	c := appengine.NewContext(r)
+func twitterThreadHandler(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	user, err := loadUserCookie(r)
+	if err != nil || !user.HasTwitter() {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if r.Method != "POST" || !checkCSRF(r) {
+		serveError(c, w, errCSRF)
+		return
+	}
+	user.TwitterThread = r.FormValue("thread") == "on"
+	if err := saveUser(c, &user); err != nil {
+		serveError(c, w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func init() {
+	registerPublisher(twitterPublisher{})
+}
+
+// twitterPublisher posts activities as tweets.
+type twitterPublisher struct{}
+
+func (twitterPublisher) Name() string { return "twitter" }
+
+func (twitterPublisher) Enabled(user *User) bool {
+	return user.HasTwitter()
+}
 
+func (twitterPublisher) Publish(c Context, user *User, post *Post) (string, error) {
 	conf := &tweetlib.Config{
 		ConsumerKey:    appConfig.TwitterConsumerKey,
 		ConsumerSecret: appConfig.TwitterConsumerSecret}
 	tok := &tweetlib.Token{OAuthToken: user.TwitterOAuthToken, OAuthSecret: user.TwitterOAuthSecret}
 	tr := &tweetlib.Transport{Config: conf,
 		Token:     tok,
-		Transport: &urlfetch.Transport{Context: c}}
+		Transport: c.Transport()}
 
 	tl, _ := tweetlib.New(tr.Client())
 
-	var attachment *plus.ActivityObjectAttachments
-	obj := act.Object
-	kind := ""
-	content := ""
-
-	if act.Verb == "share" {
-		content = act.Annotation
-		if content == "" {
-			content = "Resharing " + obj.Actor.DisplayName
-		}
-		kind = "status_share"
-	} else {
-		kind = "status"
-		if obj != nil {
-			if len(obj.Attachments) > 0 {
-				attachment = obj.Attachments[0]
-				kind = attachment.ObjectType
-			}
-			content = obj.Content
-		} else {
-			content = act.Title
-		}
-
+	act := post.Activity
+	attachment := post.Attachment
+	content := post.Content
+	if post.Kind == "status_share" && content == "" {
+		content = "Resharing " + act.ActorName
 	}
-	content = removeTags(content)
 
-	c.Debugf("Post (%s):\n\tkind: %s\n\tcontent: %s\n", user.TwitterId, kind, content)
-	var err error
-	switch kind {
+	c.Debugf("Post (%s):\n\tkind: %s\n\tcontent: %s\n", user.TwitterId, post.Kind, content)
+	var kind, link string
+	var media []string
+	switch post.Kind {
 	case "status":
 		// post a status update
-		_, err = tl.Tweets.Update(shorten(c, "status", content, act.Url, tl), nil)
+		kind, link = "status", act.Url
 	case "status_share":
-		_, err = tl.Tweets.Update(shorten(c, "link", content, act.Url, tl), nil)
+		kind, link = "link", act.Url
 	case "article":
 		// post a link
 		c.Debugf("Article (%s):\n\tcontent: %s\n\turl: %s\n", user.TwitterId, content, attachment.Url)
@@ -179,95 +202,225 @@ func publishActivityToTwitter(w http.ResponseWriter, r *http.Request, act *plus.
 				content = "Shared a link."
 			}
 		}
-		_, err = tl.Tweets.Update(shorten(c, "link", content, attachment.Url, tl), nil)
+		kind, link = "link", attachment.Url
 	case "photo":
-		// download photo
-		mediaUrl := attachment.FullImage.Url
-		fileName := path.Base(mediaUrl)
-
-		var media []byte
-		item, err := memcache.Get(c, "picture"+mediaUrl)
-		if err != nil {
-			client := urlfetch.Client(c)
-			resp, err := client.Get(attachment.FullImage.Url)
-			c.Debugf("Downloading %s (%v)\n", mediaUrl, err)
+		photos, more := post.photos(twitterMaxPhotos)
+		for _, photo := range photos {
+			data, name, err := fetchImage(c, photo.Image, twitterImageLimits)
 			if err != nil {
-				break
+				return "", err
 			}
-			media, err = ioutil.ReadAll(resp.Body)
-			c.Debugf("Reading contents of %s (%v)\n", mediaUrl, err)
+			id, err := twitterUpload(tr.Client(), name, data)
+			c.Debugf("Uploading %s to Twitter (%v)\n", photo.Image, err)
 			if err != nil {
-				break
+				return "", err
 			}
-			memcache.Add(c, &memcache.Item{Key: "picture" + mediaUrl, Value: media})
-		} else {
-			media = item.Value
+			media = append(media, id)
+		}
+		kind, link = "media", act.Url
+		if more {
+			// always link to the rest of the photos
+			kind = "link"
 		}
-		// now we post it
-		tweetMedia := &tweetlib.TweetMedia{
-			Filename: fileName,
-			Data:     media}
-		_, err = tl.Tweets.UpdateWithMedia(shorten(c, "media", content, act.Url, tl), tweetMedia, nil)
-		c.Debugf("Tweeting %s (%v)\n", mediaUrl, err)
+	case "video":
+		if content == "" {
+			content = attachment.DisplayName
+		}
+		kind, link = "link", attachment.Url
+		if attachment.Video == "" {
+			break
+		}
+		data, err := twitterVideo(c, attachment.Video)
+		if err != nil {
+			// tweet the link instead
+			c.Debugf("twitterPublisher: can't post video %s: %v\n", attachment.Video, err)
+			break
+		}
+		id, err := twitterUploadVideo(c, tr.Client(), data)
+		c.Debugf("Uploading %s to Twitter (%v)\n", attachment.Video, err)
+		if isPermanent(err) {
+			// twitter won't have it, tweet the link instead
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		media = []string{id}
+		kind, link = "media", act.Url
 	default:
-		if obj != nil {
-			_, err = tl.Tweets.Update(shorten(c, "link", content, obj.Url, tl), nil)
+		if act.ObjectUrl == "" {
+			return "", nil
 		}
+		kind, link = "link", act.ObjectUrl
 	}
 
-	c.Debugf("publishActivityToTwitter(%s): err=%v\n", kind, err)
+	var tweets []string
+	tconf := twitterConf(c, tl)
+	if user.TwitterThread {
+		tweets = twitterThread(tconf, kind, content, link)
+	} else {
+		tweets = []string{shorten(tconf, kind, content, link)}
+	}
+	id, err := tweetThread(tl, tweets, media)
+	c.Debugf("twitterPublisher(%s): %d tweets, err=%v\n", post.Kind, len(tweets), err)
+	if err != nil && (id != "" || twitterPermanent(err)) {
+		// if part of a thread went out, trying again would repeat it
+		err = permanent(err)
+	}
+	return id, err
 }
 
-// queries twitter.com for the current configuration
-func twitterConf(c appengine.Context, client *tweetlib.Client) *tweetlib.Configuration {
-	var conf *tweetlib.Configuration
-	_, err := memcache.JSON.Get(c, "twitterConfig", conf)
-	if err != nil {
-		conf, err := client.Help.Configuration()
+// twitterPermanent reports whether Twitter refused a tweet for good:
+// access was revoked or the tweet is a duplicate.
+func twitterPermanent(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"duplicate", "invalid or expired token", "could not authenticate", "suspended"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// tweetThread posts tweets, each one in reply to the one before,
+// and returns the id of the first. media are the ids of uploaded media
+// to attach to the first.
+func tweetThread(tl *tweetlib.Client, tweets []string, media []string) (string, error) {
+	var first string
+	var prev *tweetlib.Tweet
+	for _, status := range tweets {
+		opts := tweetlib.NewOptionals()
+		if prev != nil {
+			opts.Add("in_reply_to_status_id", prev.IdStr)
+			opts.Add("auto_populate_reply_metadata", true)
+		} else if len(media) > 0 {
+			opts.Add("media_ids", strings.Join(media, ","))
+		}
+		var err error
+		prev, err = tl.Tweets.Update(status, opts)
 		if err != nil {
-			return nil
+			return first, err
+		}
+		if first == "" {
+			first = prev.IdStr
 		}
-		// we have our length, let's cache it
-		// (+1 to account for the space char)
-		memcache.JSON.Set(c, &memcache.Item{Key: "twitterConfig", Object: conf})
 	}
-	return conf
+	return first, nil
 }
 
-func shorten(c appengine.Context, kind, content, url string, tl *tweetlib.Client) string {
-	max := 140
-	conf := twitterConf(c, tl)
-	if conf == nil {
-		// use some reasonable defaults if we could not
-		// query twitter.com
-		conf = &tweetlib.Configuration{
-			CharactersReservedPerMedia: 25,
-			ShortUrlLengthHttps:        25,
-			ShortUrlLength:             24,
+// most tweets in a thread; the rest of the content is cut
+const tweetThreadMax = 10
+
+// queries twitter.com for the current configuration
+func twitterConf(c Context, client *tweetlib.Client) *tweetlib.Configuration {
+	conf := new(tweetlib.Configuration)
+	if err := cacheGetJSON(c, "twitterConfig", conf); err != nil {
+		conf, err = client.Help.Configuration()
+		if err != nil {
+			// use some reasonable defaults if we could not
+			// query twitter.com
+			return &tweetlib.Configuration{
+				CharactersReservedPerMedia: 24,
+				ShortUrlLengthHttps:        23,
+				ShortUrlLength:             23,
+			}
 		}
+		cacheSetJSON(c, "twitterConfig", conf, twitterConfigCacheTTL)
 	}
+	return conf
+}
+
+// shorten fits content and url in a tweet, cutting content if needed.
+// url is left out of "status" tweets that fit without it.
+func shorten(conf *tweetlib.Configuration, kind, content, url string) string {
+	content = norm.NFC.String(content)
+	max := tweetMaxLength()
 	if kind == "media" {
 		// -1 for the space character
 		max = max - conf.CharactersReservedPerMedia - 1
 		kind = "status"
 	}
 
-	if kind == "status" && len(content) <= max {
+	n := tweetLen(conf, content)
+	if kind == "status" && n <= max {
 		return content
 	}
 
-	var tcl int
-	if strings.HasPrefix(url, "https:") {
-		tcl = conf.ShortUrlLengthHttps
+	// leave room for URL (shortened by twitter) and a space
+	l := max - tcoLength(conf, url) - 1
+	if l < n {
+		content = strings.TrimRightFunc(tweetPrefix(conf, content, l-3), unicode.IsSpace)
+		return fmt.Sprintf("%s... %s", content, url)
+	}
+	return fmt.Sprintf("%s %s", content, url)
+}
+
+// twitterThread splits content into numbered tweets, breaking at
+// sentence or word boundaries, with url at the end of the last one.
+// The first leaves room for media if kind is "media". Content that
+// fits in a single tweet is left as shorten would.
+func twitterThread(conf *tweetlib.Configuration, kind, content, url string) []string {
+	first := tweetMaxLength()
+	if kind == "media" {
+		first = first - conf.CharactersReservedPerMedia - 1
+	}
+	linkLen := tcoLength(conf, url) + 1
+	content = norm.NFC.String(strings.TrimSpace(content))
+	n := tweetLen(conf, content)
+	if n <= first-linkLen || (kind != "link" && n <= first) {
+		return []string{shorten(conf, kind, content, url)}
+	}
+
+	// leave room for the "10/10 " numbering
+	const numLen = 6
+	var tweets []string
+	max := first - numLen
+	for content != "" {
+		var t string
+		if len(tweets) == tweetThreadMax-2 {
+			// cut the rest, keeping the last tweet in case the
+			// link needs one of its own
+			t, content = tweetPrefix(conf, content, max-3)+"...", ""
+		} else {
+			t, content = splitTweet(conf, content, max)
+		}
+		tweets = append(tweets, t)
+		max = tweetMaxLength() - numLen
+	}
+	last := len(tweets) - 1
+	if tweetLen(conf, tweets[last])+linkLen <= max {
+		tweets[last] += " " + url
 	} else {
-		tcl = conf.ShortUrlLength
+		tweets = append(tweets, url)
 	}
-	// add room for a space
-	tcl++
-	// leave room for URL (shortened by twitter)
-	l := max - tcl
-	if l < len(content) {
-		return fmt.Sprintf("%s... %s", content[:l-3], url)
+
+	for i := range tweets {
+		tweets[i] = fmt.Sprintf("%d/%d %s", i+1, len(tweets), tweets[i])
 	}
-	return fmt.Sprintf("%s %s", content, url)
+	return tweets
+}
+
+// splitTweet returns the start of s that fits in max characters,
+// ending at a sentence or word boundary if there is one, and the rest.
+func splitTweet(conf *tweetlib.Configuration, s string, max int) (tweet, rest string) {
+	s = norm.NFC.String(s)
+	head := tweetPrefix(conf, s, max)
+	if head == s {
+		return s, ""
+	}
+
+	cut := -1
+	for _, sep := range []string{". ", "! ", "? ", "\n"} {
+		if i := strings.LastIndex(head, sep); i >= 0 && i+1 > cut {
+			cut = i + 1
+		}
+	}
+	if cut < len(head)/2 {
+		// no sentence ends late enough, break between words
+		cut = strings.LastIndexAny(head, " \t\n")
+		if cut <= 0 {
+			cut = len(head)
+		}
+	}
+	return strings.TrimSpace(s[:cut]), strings.TrimSpace(s[cut:])
 }
@@ -0,0 +1,104 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testTweetURL = "https://plus.google.com/1/posts/abc"
+
+func TestShorten(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	tests := []struct {
+		kind, content string
+		want          string
+	}{
+		{"status", "hello", "hello"},
+		{"link", "hello", "hello " + testTweetURL},
+		{"status", long, strings.TrimSpace(long[:280-23-1-3]) + "... " + testTweetURL},
+		{"media", long, strings.TrimSpace(long[:280-24-1-23-1-3]) + "... " + testTweetURL},
+		{"status", strings.Repeat("語", 140), strings.Repeat("語", 140)},
+		{"status", strings.Repeat("語", 141), strings.Repeat("語", 126) + "... " + testTweetURL},
+	}
+	for _, tt := range tests {
+		if got := shorten(testTwitterConf, tt.kind, tt.content, testTweetURL); got != tt.want {
+			t.Errorf("shorten(%q, %.20q...) = %q, want %q", tt.kind, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTweet(t *testing.T) {
+	tests := []struct {
+		s           string
+		max         int
+		tweet, rest string
+	}{
+		{"short", 10, "short", ""},
+		{"One two. Three four five six", 14, "One two.", "Three four five six"},
+		{"One two three four five six", 20, "One two three four", "five six"},
+		{"A. Then a much longer sentence", 20, "A. Then a much", "longer sentence"},
+		{"Onetwothreefourfivesix", 10, "Onetwothre", "efourfivesix"},
+		{"日本語の文章です。次の文", 12, "日本語の文章", "です。次の文"},
+	}
+	for _, tt := range tests {
+		tweet, rest := splitTweet(testTwitterConf, tt.s, tt.max)
+		if tweet != tt.tweet || rest != tt.rest {
+			t.Errorf("splitTweet(%q, %d) = %q, %q, want %q, %q", tt.s, tt.max, tweet, rest, tt.tweet, tt.rest)
+		}
+	}
+}
+
+func TestTwitterThread(t *testing.T) {
+	sentence := "This sentence is part of a long post. "
+	tests := []struct {
+		kind    string
+		content string
+		n       int // tweets
+	}{
+		{"status", "Short post.", 1},
+		{"link", strings.Repeat(sentence, 6), 1},
+		{"link", strings.Repeat(sentence, 7), 2},
+		{"status", strings.Repeat(sentence, 20), 3},
+		// the first leaves room for the media, the link needs one more
+		{"media", strings.Repeat(sentence, 20), 4},
+		{"status", strings.Repeat("語", 400), 4},
+		// cut, leaving the last tweet for the link
+		{"status", strings.Repeat(sentence, 200), tweetThreadMax},
+	}
+	for _, tt := range tests {
+		tweets := twitterThread(testTwitterConf, tt.kind, tt.content, testTweetURL)
+		if len(tweets) != tt.n {
+			t.Errorf("twitterThread(%q, %d chars) = %d tweets, want %d", tt.kind, len(tt.content), len(tweets), tt.n)
+			continue
+		}
+		if tt.n == 1 {
+			want := shorten(testTwitterConf, tt.kind, strings.TrimSpace(tt.content), testTweetURL)
+			if tweets[0] != want {
+				t.Errorf("twitterThread(%q, %q) = %q, want %q", tt.kind, tt.content, tweets[0], want)
+			}
+			continue
+		}
+		for i, tweet := range tweets {
+			max := tweetMaxLength()
+			if i == 0 && tt.kind == "media" {
+				max -= testTwitterConf.CharactersReservedPerMedia + 1
+			}
+			if n := tweetLen(testTwitterConf, tweet); n > max {
+				t.Errorf("twitterThread(%q, %d chars): tweet %d counts for %d", tt.kind, len(tt.content), i+1, n)
+			}
+			if prefix := fmt.Sprintf("%d/%d ", i+1, len(tweets)); !strings.HasPrefix(tweet, prefix) {
+				t.Errorf("twitterThread(%q, %d chars): tweet %d = %q, want it numbered %q", tt.kind, len(tt.content), i+1, tweet, prefix)
+			}
+		}
+		if last := tweets[len(tweets)-1]; !strings.HasSuffix(last, " "+testTweetURL) {
+			t.Errorf("twitterThread(%q, %d chars): last tweet %q doesn't end with the link", tt.kind, len(tt.content), last)
+		}
+	}
+}
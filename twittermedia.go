@@ -0,0 +1,276 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	twitterUploadURL = "https://upload.twitter.com/1.1/media/upload.json"
+	// most photos a tweet can have
+	twitterMaxPhotos = 4
+
+	// limits for videos; twitter accepts larger files, but we'd
+	// rather not hold them in memory
+	twitterMaxVideoBytes    = 15 << 20
+	twitterMinVideoDuration = 500 * time.Millisecond
+	twitterMaxVideoDuration = 140 * time.Second
+	// videos are uploaded in chunks of this size
+	twitterVideoChunk = 1 << 20
+	// how long we wait for twitter to process a video, at most and
+	// between checks
+	twitterVideoTimeout = 2 * time.Minute
+	twitterVideoMinWait = time.Second
+)
+
+var twitterImageLimits = imageLimits{
+	MaxWidth:  4096,
+	MaxHeight: 4096,
+	MaxBytes:  5 << 20,
+	Formats:   []string{"jpeg", "png", "gif"},
+}
+
+var errTwitterVideo = errors.New("twitter: video is not an MP4 twitter accepts")
+
+type twitterMediaResponse struct {
+	MediaId        string `json:"media_id_string"`
+	ProcessingInfo *struct {
+		State          string `json:"state"`
+		CheckAfterSecs int    `json:"check_after_secs"`
+		Error          struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"processing_info"`
+}
+
+// twitterMedia calls the media upload endpoint. POST requests are sent
+// as multipart forms, with media as a file if it is not nil. The
+// response is decoded into v if it is not nil.
+func twitterMedia(client *http.Client, method string, params url.Values, fileName string, media []byte, v interface{}) error {
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest("GET", twitterUploadURL+"?"+params.Encode(), nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for k, vs := range params {
+			for _, s := range vs {
+				mw.WriteField(k, s)
+			}
+		}
+		if media != nil {
+			fw, err := mw.CreateFormFile("media", fileName)
+			if err != nil {
+				return err
+			}
+			fw.Write(media)
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		req, err = http.NewRequest(method, twitterUploadURL, &buf)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("twitter: media upload: %s", resp.Status)
+		if httpPermanent(resp.StatusCode) {
+			// e.g. a file of the wrong type or too large
+			return permanent(err)
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// twitterUpload uploads media to be attached to a tweet and returns its
+// id. client must sign requests for the user.
+func twitterUpload(client *http.Client, fileName string, data []byte) (string, error) {
+	var m twitterMediaResponse
+	if err := twitterMedia(client, "POST", nil, fileName, data, &m); err != nil {
+		return "", err
+	}
+	return m.MediaId, nil
+}
+
+// twitterUploadVideo uploads an MP4 video in chunks and waits for
+// twitter to process it, but not past the sync deadline of c. It
+// returns the media id. Videos twitter won't take, or fails to
+// process, give a permanent error.
+func twitterUploadVideo(c Context, client *http.Client, data []byte) (string, error) {
+	var m twitterMediaResponse
+	err := twitterMedia(client, "POST", url.Values{
+		"command":        {"INIT"},
+		"total_bytes":    {strconv.Itoa(len(data))},
+		"media_type":     {"video/mp4"},
+		"media_category": {"tweet_video"},
+	}, "", nil, &m)
+	if err != nil {
+		return "", err
+	}
+	id := m.MediaId
+
+	for i := 0; len(data) > 0; i++ {
+		n := len(data)
+		if n > twitterVideoChunk {
+			n = twitterVideoChunk
+		}
+		err := twitterMedia(client, "POST", url.Values{
+			"command":       {"APPEND"},
+			"media_id":      {id},
+			"segment_index": {strconv.Itoa(i)},
+		}, "video.mp4", data[:n], nil)
+		if err != nil {
+			return "", err
+		}
+		data = data[n:]
+	}
+
+	m = twitterMediaResponse{}
+	err = twitterMedia(client, "POST", url.Values{"command": {"FINALIZE"}, "media_id": {id}}, "", nil, &m)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(twitterVideoTimeout)
+	if d, ok := syncDeadline(c); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for m.ProcessingInfo != nil {
+		switch m.ProcessingInfo.State {
+		case "succeeded":
+			return id, nil
+		case "failed":
+			// uploading it again would fail the same way
+			return "", permanent(fmt.Errorf("twitter: video processing failed: %s", m.ProcessingInfo.Error.Message))
+		}
+		wait := time.Duration(m.ProcessingInfo.CheckAfterSecs) * time.Second
+		if wait < twitterVideoMinWait {
+			wait = twitterVideoMinWait
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return "", errors.New("twitter: timed out waiting for video processing")
+		}
+		time.Sleep(wait)
+		m = twitterMediaResponse{}
+		err = twitterMedia(client, "GET", url.Values{"command": {"STATUS"}, "media_id": {id}}, "", nil, &m)
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// twitterVideo downloads the video at videoUrl, or reads it if it was
+// kept from a Takeout archive, checking that it's one twitter accepts:
+// an MP4 of the right size and duration.
+func twitterVideo(c Context, videoUrl string) ([]byte, error) {
+	var data []byte
+	var err error
+	if isTakeoutMedia(videoUrl) {
+		data, err = loadTakeoutMedia(c, videoUrl)
+	} else {
+		data, err = twitterDownloadVideo(c, videoUrl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > twitterMaxVideoBytes {
+		return nil, errTwitterVideo
+	}
+	d, err := mp4Duration(data)
+	if err != nil || d < twitterMinVideoDuration || d > twitterMaxVideoDuration {
+		return nil, errTwitterVideo
+	}
+	return data, nil
+}
+
+func twitterDownloadVideo(c Context, videoUrl string) ([]byte, error) {
+	resp, err := httpClient(c).Get(videoUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("twitter: downloading video: %s", resp.Status)
+	}
+	if resp.ContentLength > twitterMaxVideoBytes {
+		return nil, errTwitterVideo
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, twitterMaxVideoBytes+1))
+}
+
+// mp4Duration reads the duration of an MP4 video from its movie header.
+func mp4Duration(data []byte) (time.Duration, error) {
+	mvhd := mp4Box(mp4Box(data, "moov"), "mvhd")
+	var timescale uint32
+	var duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = binary.BigEndian.Uint32(mvhd[12:])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = binary.BigEndian.Uint32(mvhd[20:])
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	}
+	if timescale == 0 {
+		return 0, errors.New("mp4: no movie header")
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+// mp4Box returns the contents of the first box of type typ in data.
+func mp4Box(data []byte, typ string) []byte {
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil
+		}
+		if string(data[4:8]) == typ {
+			return data[header:size]
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBox(typ string, content ...[]byte) []byte {
+	n := 8
+	for _, c := range content {
+		n += len(c)
+	}
+	b := make([]byte, 8, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], typ)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// testLargeBox is testBox with a 64 bit size.
+func testLargeBox(typ string, content []byte) []byte {
+	b := make([]byte, 16, 16+len(content))
+	binary.BigEndian.PutUint32(b, 1)
+	copy(b[4:], typ)
+	binary.BigEndian.PutUint64(b[8:], uint64(16+len(content)))
+	return append(b, content...)
+}
+
+func testMvhd(version byte, timescale uint32, duration uint64) []byte {
+	if version == 0 {
+		b := make([]byte, 20)
+		binary.BigEndian.PutUint32(b[12:], timescale)
+		binary.BigEndian.PutUint32(b[16:], uint32(duration))
+		return testBox("mvhd", b)
+	}
+	b := make([]byte, 32)
+	b[0] = 1
+	binary.BigEndian.PutUint32(b[20:], timescale)
+	binary.BigEndian.PutUint64(b[24:], duration)
+	return testBox("mvhd", b)
+}
+
+func TestMP4Duration(t *testing.T) {
+	ftyp := testBox("ftyp", []byte("isom\x00\x00\x02\x00"))
+	mdat := testBox("mdat", make([]byte, 100))
+	tests := []struct {
+		name string
+		data []byte
+		want time.Duration
+		ok   bool
+	}{
+		{"v0", concat(ftyp, testBox("moov", testMvhd(0, 1000, 12500)), mdat), 12500 * time.Millisecond, true},
+		{"v1", concat(ftyp, mdat, testBox("moov", testBox("free"), testMvhd(1, 90000, 90000*60))), time.Minute, true},
+		{"large box", concat(testLargeBox("mdat", make([]byte, 10)), testBox("moov", testMvhd(0, 600, 300))), 500 * time.Millisecond, true},
+		{"box to the end", concat(ftyp, []byte{0, 0, 0, 0}, []byte("moov"), testMvhd(0, 1, 3)), 3 * time.Second, true},
+		{"no moov", concat(ftyp, mdat), 0, false},
+		{"no mvhd", concat(ftyp, testBox("moov", testBox("trak"))), 0, false},
+		{"short mvhd", testBox("moov", testBox("mvhd", make([]byte, 10))), 0, false},
+		{"zero timescale", testBox("moov", testMvhd(0, 0, 10)), 0, false},
+		{"truncated", concat(ftyp, testBox("moov", testMvhd(0, 1000, 1000)))[:30], 0, false},
+		{"bad size", []byte{0, 0, 0, 4, 'm', 'o', 'o', 'v'}, 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, tt := range tests {
+		d, err := mp4Duration(tt.data)
+		if (err == nil) != tt.ok || d != tt.want {
+			t.Errorf("%s: mp4Duration = %v, %v, want %v, ok=%v", tt.name, d, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	var data []byte
+	for _, b := range bs {
+		data = append(data, b...)
+	}
+	return data
+}
+
+// testRoundTripper answers requests with f.
+type testRoundTripper func(req *http.Request) *http.Response
+
+func (f testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+func testResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestTwitterMediaErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusRequestEntityTooLarge, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		client := &http.Client{Transport: testRoundTripper(func(req *http.Request) *http.Response {
+			return testResponse(tt.status, `{"errors": []}`)
+		})}
+		_, err := twitterUpload(client, "photo.jpg", []byte("data"))
+		if err == nil || isPermanent(err) != tt.permanent {
+			t.Errorf("upload answered %d: err=%v, want permanent=%v", tt.status, err, tt.permanent)
+		}
+	}
+}
+
+func TestTwitterUploadVideoFailed(t *testing.T) {
+	client := &http.Client{Transport: testRoundTripper(func(req *http.Request) *http.Response {
+		req.ParseMultipartForm(1 << 20)
+		switch req.FormValue("command") {
+		case "INIT":
+			return testResponse(http.StatusAccepted, `{"media_id_string": "1"}`)
+		case "APPEND":
+			return testResponse(http.StatusNoContent, ``)
+		}
+		return testResponse(http.StatusOK, `{"media_id_string": "1",
+			"processing_info": {"state": "failed", "error": {"message": "bad video"}}}`)
+	})}
+	_, err := twitterUploadVideo(testContext{t}, client, make([]byte, 100))
+	if err == nil || !isPermanent(err) {
+		t.Errorf("twitterUploadVideo = %v, want a permanent error", err)
+	}
+}
@@ -0,0 +1,180 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/tweetlib.v2"
+)
+
+// Tweets are measured the way twitter-text does: most characters
+// count as 2, except Latin and some punctuation, which count as 1. An
+// emoji counts as 2 however many code points make it up, and a URL
+// counts as long as the t.co link twitter replaces it with. Text is
+// counted in NFC, as twitter normalizes it first, so an "e" followed
+// by a combining accent counts as the one "é" it becomes.
+
+const tweetDefaultMaxLength = 280
+
+// tweetMaxLength is the most a tweet may count for.
+func tweetMaxLength() int {
+	if appConfig.TwitterMaxLength > 0 {
+		return appConfig.TwitterMaxLength
+	}
+	return tweetDefaultMaxLength
+}
+
+// code points in these ranges count as 1
+var tweetLightRanges = []struct{ lo, hi rune }{
+	{0x0000, 0x10ff},
+	{0x2000, 0x200d},
+	{0x2010, 0x201f},
+	{0x2032, 0x2037},
+}
+
+var tweetURL = regexp.MustCompile(`https?://[^\s<>"]*[^\s<>".,;:!?)\]'"]`)
+
+// tcoLength is how many characters url counts for once twitter
+// shortens it.
+func tcoLength(conf *tweetlib.Configuration, url string) int {
+	if strings.HasPrefix(url, "https:") {
+		return conf.ShortUrlLengthHttps
+	}
+	return conf.ShortUrlLength
+}
+
+// tweetUnits calls f with the bounds and weight of each piece of s
+// that can't be split: URLs and grapheme clusters. It stops early if f
+// returns false.
+func tweetUnits(conf *tweetlib.Configuration, s string, f func(i, j, weight int) bool) {
+	urls := tweetURL.FindAllStringIndex(s, -1)
+	for i := 0; i < len(s); {
+		if len(urls) > 0 && urls[0][0] == i {
+			j := urls[0][1]
+			urls = urls[1:]
+			if !f(i, j, tcoLength(conf, s[i:j])) {
+				return
+			}
+			i = j
+			continue
+		}
+		j := i + nextGrapheme(s[i:])
+		if len(urls) > 0 && j > urls[0][0] {
+			j = urls[0][0]
+		}
+		if !f(i, j, graphemeWeight(s[i:j])) {
+			return
+		}
+		i = j
+	}
+}
+
+// tweetLen is how many characters s counts for in a tweet.
+func tweetLen(conf *tweetlib.Configuration, s string) int {
+	s = norm.NFC.String(s)
+	n := 0
+	tweetUnits(conf, s, func(i, j, weight int) bool {
+		n += weight
+		return true
+	})
+	return n
+}
+
+// tweetPrefix returns the longest prefix of s, in NFC, that counts for
+// at most max characters, without splitting URLs or grapheme clusters.
+func tweetPrefix(conf *tweetlib.Configuration, s string, max int) string {
+	s = norm.NFC.String(s)
+	n, end := 0, 0
+	tweetUnits(conf, s, func(i, j, weight int) bool {
+		if n+weight > max {
+			return false
+		}
+		n += weight
+		end = j
+		return true
+	})
+	return s[:end]
+}
+
+// nextGrapheme returns the length of the grapheme cluster s starts
+// with. It follows the Unicode rules closely enough for tweets:
+// combining marks, variation selectors, emoji modifiers and tags
+// extend a cluster, ZWJ joins two clusters and regional indicators
+// pair up into flags.
+func nextGrapheme(s string) int {
+	r, n := utf8.DecodeRuneInString(s)
+	if r == '\r' && strings.HasPrefix(s[n:], "\n") {
+		return n + 1
+	}
+	flag := isRegionalIndicator(r)
+	for n < len(s) {
+		next, size := utf8.DecodeRuneInString(s[n:])
+		switch {
+		case extendsGrapheme(next):
+		case r == '\u200d' && !unicode.IsSpace(next):
+		case flag && isRegionalIndicator(next):
+			flag = false
+		default:
+			return n
+		}
+		r = next
+		n += size
+	}
+	return n
+}
+
+func extendsGrapheme(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == '\u200d' ||
+		(r >= 0xfe00 && r <= 0xfe0f) ||
+		(r >= 0x1f3fb && r <= 0x1f3ff) ||
+		(r >= 0xe0020 && r <= 0xe007f)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// isEmoji reports whether the grapheme cluster g is an emoji.
+func isEmoji(g string) bool {
+	r, _ := utf8.DecodeRuneInString(g)
+	switch {
+	case r >= 0x1f000 && r <= 0x1faff,
+		r >= 0x2600 && r <= 0x27bf,
+		r >= 0x2300 && r <= 0x23ff,
+		r >= 0x2b00 && r <= 0x2bff:
+		return true
+	}
+	// text characters followed by the emoji presentation selector or
+	// a keycap, such as the copyright sign or digits as emoji
+	return strings.ContainsAny(g, "\ufe0f\u20e3")
+}
+
+func graphemeWeight(g string) int {
+	if isEmoji(g) {
+		return 2
+	}
+	n := 0
+	for _, r := range g {
+		n += runeWeight(r)
+	}
+	return n
+}
+
+func runeWeight(r rune) int {
+	for _, lr := range tweetLightRanges {
+		if r >= lr.lo && r <= lr.hi {
+			return 1
+		}
+	}
+	return 2
+}
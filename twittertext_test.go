@@ -0,0 +1,73 @@
+// gplus2others - Send Google+ activities to other networks
+//
+// Copyright 2011 The gplus2others Authors.  All rights reserved.
+// Use of this source code is governed by the Simplified BSD
+// license that can be found in the LICENSE file.
+
+package gplus2others
+
+import (
+	"testing"
+
+	"gopkg.in/tweetlib.v2"
+)
+
+var testTwitterConf = &tweetlib.Configuration{
+	CharactersReservedPerMedia: 24,
+	ShortUrlLengthHttps:        23,
+	ShortUrlLength:             23,
+}
+
+func TestTweetLen(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"café", 4},
+		{"cafe\u0301", 4}, // becomes "café" in NFC
+		{"日本語", 6},
+		{"한국어", 6},
+		{"“quotes”…", 10}, // but not the ellipsis
+		{"\U0001f600", 2},
+		{"\U0001f44d\U0001f3fd", 2}, // skin tone
+		{"\U0001f468\u200d\U0001f469\u200d\U0001f467\u200d\U0001f466", 2}, // ZWJ sequence
+		{"\U0001f1e8\U0001f1e6", 2},                                       // flag
+		{"\U0001f1e8\U0001f1e6\U0001f1e7\U0001f1f7", 4},                   // two flags
+		{"\u00a9\ufe0f", 2},                                               // emoji presentation
+		{"1\ufe0f\u20e3", 2},                                              // keycap
+		{"see https://example.com/a/very/long/path/indeed", 4 + 23},
+		{"http://example.com.", 23 + 1},
+		{"日本 https://example.com 語", 5 + 23 + 3},
+	}
+	for _, tt := range tests {
+		if got := tweetLen(testTwitterConf, tt.s); got != tt.want {
+			t.Errorf("tweetLen(%+q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTweetPrefix(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"日本語", 5, "日本"},
+		{"a\U0001f600b", 2, "a"},
+		{"a\U0001f468\u200d\U0001f469\u200d\U0001f467b", 3, "a\U0001f468\u200d\U0001f469\u200d\U0001f467"},
+		{"\U0001f1e8\U0001f1e6\U0001f1e7\U0001f1f7", 3, "\U0001f1e8\U0001f1e6"},
+		{"cafe\u0301s", 4, "caf\u00e9"},
+		{"go https://example.com/x now", 20, "go "},
+		{"go https://example.com/x now", 26, "go https://example.com/x"},
+	}
+	for _, tt := range tests {
+		got := tweetPrefix(testTwitterConf, tt.s, tt.max)
+		if got != tt.want {
+			t.Errorf("tweetPrefix(%+q, %d) = %+q, want %+q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
@@ -10,31 +10,60 @@ type User struct {
 	Id string
 
 	// Google
-	GoogleAccessToken  string `json:"access_token"`
-	GoogleRefreshToken string `json:"refresh_token"`
+	GoogleAccessToken  string `json:"access_token" datastore:",noindex"`
+	GoogleRefreshToken string `json:"refresh_token" datastore:",noindex"`
 	GoogleTokenExpiry  int64  `json:"expires_in"`
 
 	GoogleLatest int64
+	GoogleSeen   []string `datastore:",noindex"`
+	// GoogleSince is when the user signed up; only posts after it
+	// were synced. Zero for users from before it was kept.
+	GoogleSince int64
+
+	// RSS/Atom feed
+	FeedURL    string
+	FeedLatest int64
+	FeedSeen   []string `datastore:",noindex"`
 
 	// Twitter Info
-	TwitterOAuthToken  string
-	TwitterOAuthSecret string
+	TwitterOAuthToken  string `datastore:",noindex"`
+	TwitterOAuthSecret string `datastore:",noindex"`
 	TwitterScreenName  string
 	TwitterId          string
 	TwitterSinceId     string
+	// Post content that doesn't fit in a tweet as a thread
+	TwitterThread bool
 
 	// app.net
-	ADNAccessToken string
+	ADNAccessToken string `datastore:",noindex"`
 	ADNScreenName  string
 	ADNId          string
 
+	// Mastodon
+	MastodonInstance    string
+	MastodonAccessToken string `datastore:",noindex"`
+	MastodonId          string
+	MastodonUsername    string
+	MastodonVisibility  string
+
+	// Bluesky
+	BlueskyDid        string
+	BlueskyHandle     string
+	BlueskyAccessJwt  string `datastore:",noindex"`
+	BlueskyRefreshJwt string `datastore:",noindex"`
+
 	//FB Info
-	FBAccessToken string
+	FBAccessToken string `datastore:",noindex"`
 	FBName        string
 	FBId          string
 
 	Active bool
 
+	// TokenDataKey is the key the tokens above are encrypted with
+	// when stored, itself encrypted with TokenEncryptionKey. See
+	// tokencrypt.go.
+	TokenDataKey string `datastore:",noindex"`
+
 	// Services the user has access to
 //	Services []Services
 }
@@ -51,6 +80,14 @@ func (user *User) HasADN() bool {
 	return (user.ADNId != "")
 }
 
+func (user *User) HasMastodon() bool {
+	return (user.MastodonId != "")
+}
+
+func (user *User) HasBluesky() bool {
+	return (user.BlueskyDid != "")
+}
+
 func (user *User) DisableTwitter() {
 	user.TwitterId = ""
 	user.TwitterOAuthSecret = ""
@@ -70,6 +107,21 @@ func (user *User) DisableADN() {
 	user.ADNScreenName = ""
 }
 
+func (user *User) DisableMastodon() {
+	user.MastodonId = ""
+	user.MastodonAccessToken = ""
+	user.MastodonUsername = ""
+	user.MastodonInstance = ""
+}
+
+func (user *User) DisableBluesky() {
+	user.BlueskyDid = ""
+	user.BlueskyHandle = ""
+	user.BlueskyAccessJwt = ""
+	user.BlueskyRefreshJwt = ""
+}
+
 func (user *User) enableIfNeeded() {
-	user.Active = (user.FBId != "" || user.TwitterId != "" || user.ADNId != "")
+	user.Active = (user.FBId != "" || user.TwitterId != "" || user.ADNId != "" ||
+		user.MastodonId != "" || user.BlueskyDid != "")
 }
@@ -7,30 +7,39 @@
 package gplus2others
 
 import (
-	"html"
+	"errors"
+	"net"
 	"net/http"
-	"regexp"
+	"strings"
 	"time"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
-)
-
-var (
-	reParagraphs = regexp.MustCompile("</p>")
-	reBreaks     = regexp.MustCompile("<br */?>")
-	reTags       = regexp.MustCompile("<[^>]+>")
 )
 
-// 1. convert </p> to new line
-// 2. convert <br/> to new line
-// 3. strip all tags
-
-func removeTags(str string) string {
-	str = reParagraphs.ReplaceAllString(str, "\n")
-	str = reBreaks.ReplaceAllString(str, "\n")
-	return html.UnescapeString(reTags.ReplaceAllString(str, ""))
+// errUserUnreadable is returned for users whose tokens can't be
+// decrypted. They must not be overwritten, or the tokens are lost.
+var errUserUnreadable = errors.New("Your account can't be read right now, please try again later")
+
+// publicHost reports whether host is on the internet rather than one
+// of the machines around the app's, which users have no business
+// making it talk to.
+func publicHost(host string) bool {
+	host = strings.ToLower(host)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return false
+		}
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+			return false
+		}
+	}
+	return true
 }
 
 func serve404(w http.ResponseWriter) {
@@ -39,41 +48,70 @@ func serve404(w http.ResponseWriter) {
 	templates.ExecuteTemplate(w, "404", nil)
 }
 
-func serveError(c appengine.Context, w http.ResponseWriter, err error) {
+func serveError(c Context, w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	templates.ExecuteTemplate(w, "error", err)
 	c.Errorf("serveError: %v\n", err)
 }
 
-func loadUser(r *http.Request, id string) User {
-	c := appengine.NewContext(r)
+// loadUser returns the user with the id, or ErrNoSuchEntity if there
+// is none. On any other error the user may exist, so callers must not
+// save a new one in its place.
+func loadUser(c Context, id string) (User, error) {
 	var user User
-	_, err := memcache.JSON.Get(c, "user"+id, &user)
-	if err == nil {
-		return user
+	err := cacheGetJSON(c, "user"+id, &user)
+	if err != nil {
+		u, err := users.Get(c, id)
+		if err != nil {
+			if err != ErrNoSuchEntity {
+				c.Errorf("loadUser(%s): can't load user. Err: %v\n", id, err)
+			}
+			return User{}, err
+		}
+		user = *u
 	}
 
-	key := datastore.NewKey(c, "User", id, 0, nil)
-	if err := datastore.Get(c, key, &user); err != nil {
-		user.Id = ""
-		user.Active = false
+	resave, err := openUser(&user)
+	if err != nil {
+		c.Errorf("loadUser(%s): can't decrypt tokens. Err: %v\n", id, err)
+		return User{}, errUserUnreadable
+	}
+	if resave {
+		saveUser(c, &user)
 	}
-	return user
+	return user, nil
 }
 
-func saveUser(r *http.Request, user *User) error {
-	c := appengine.NewContext(r)
-
+func saveUser(c Context, user *User) error {
 	a := user.Active
 	user.enableIfNeeded()
 	if user.Active != a && user.Active { // user just enabled
-		user.GoogleLatest = time.Now().UnixNano()
+		// start from now, not from when a source was linked
+		now := time.Now().UnixNano()
+		for _, src := range sources {
+			src.SetLatest(user, now)
+			src.SetSeen(user, nil)
+		}
+	}
+	sealed, err := sealUser(user)
+	if err != nil {
+		return err
+	}
+	cacheSetJSON(c, "user"+user.Id, sealed, userCacheTTL)
+	return users.Put(c, &sealed)
+}
+
+func deleteUser(c Context, id string) error {
+	memUserDelete(c, id)
+	cache.Delete(c, "user"+id)
+	if err := deliveries.DeleteUser(c, id); err != nil {
+		return err
+	}
+	if err := deleteTakeoutMedia(c, id); err != nil {
+		return err
 	}
-	memcache.JSON.Set(c, &memcache.Item{Key: "user" + user.Id, Object: *user})
-	key := datastore.NewKey(c, "User", user.Id, 0, nil)
-	_, err := datastore.Put(c, key, user)
-	return err
+	return users.Delete(c, id)
 }
 
 type MemoryUser struct {
@@ -81,15 +119,15 @@ type MemoryUser struct {
 	Image string
 }
 
-func memUser(c appengine.Context, id string) (mu MemoryUser) {
-	memcache.JSON.Get(c, "memuser"+id, &mu)
+func memUser(c Context, id string) (mu MemoryUser) {
+	cacheGetJSON(c, "memuser"+id, &mu)
 	return
 }
 
-func memUserSave(c appengine.Context, id string, mu MemoryUser) {
-	memcache.JSON.Set(c, &memcache.Item{Key: "memuser" + id, Object: mu})
+func memUserSave(c Context, id string, mu MemoryUser) {
+	cacheSetJSON(c, "memuser"+id, mu, memUserCacheTTL)
 }
 
-func memUserDelete(c appengine.Context, id string) {
-	memcache.Delete(c, "memuser"+id)
+func memUserDelete(c Context, id string) {
+	cache.Delete(c, "memuser"+id)
 }